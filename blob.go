@@ -0,0 +1,116 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package recorder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// blobPrefix prefixes references to blobs, identifying the hash function used
+// to address them.
+const blobPrefix = "sha256:"
+
+// WithBlobs is used to configure the directory a Recorder stores large outputs
+// in, as separate "blob" files, instead of inline in the recording (see
+// WithBlobThreshold). Blobs are named by the SHA-256 hash of their contents, so
+// identical outputs share a single blob. When replaying, references to blobs
+// found in the recording are resolved lazily, as the corresponding operations
+// are played back.
+//
+//   <command>
+//   ---- blob sha256:<hash>
+//
+// Blobs that are no longer referenced (say, after re-recording) are not
+// removed, and can be safely deleted by hand.
+func WithBlobs(dir string) Option {
+	return func(r *Recorder) {
+		r.blobs = dir
+	}
+}
+
+// WithBlobThreshold is used to configure a Recorder (set to record) to store
+// outputs larger than the given size, in bytes, as separate blob files (see
+// WithBlobs). By default, all outputs are stored inline.
+func WithBlobThreshold(size int) Option {
+	return func(r *Recorder) {
+		r.blobThreshold = size
+	}
+}
+
+// externalize writes out the output of the given operation as a blob, if it's
+// larger than the configured threshold, returning an operation that references
+// it instead.
+func (r *Recorder) externalize(op operation) (operation, error) {
+	if r.blobThreshold <= 0 || len(op.output) <= r.blobThreshold || op.blob != "" {
+		return op, nil
+	}
+	if r.blobs == "" {
+		return operation{}, fmt.Errorf("misconfigured recorder: blob threshold set without a blob directory (see WithBlobs)")
+	}
+
+	sum := sha256.Sum256([]byte(op.output))
+	digest := hex.EncodeToString(sum[:])
+	path := filepath.Join(r.blobs, digest)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := os.MkdirAll(r.blobs, 0755); err != nil {
+			return operation{}, fmt.Errorf("unable to create directory for blobs: %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(op.output), 0644); err != nil {
+			return operation{}, fmt.Errorf("unable to write blob for %q: %v", op.command, err)
+		}
+	} else if err != nil {
+		return operation{}, err
+	}
+
+	op.blob = blobPrefix + digest
+	op.output = ""
+	return op, nil
+}
+
+// resolve reads in the output of the given operation, if it references a blob.
+func (r *Recorder) resolve(op operation) (operation, error) {
+	if op.blob == "" {
+		return op, nil
+	}
+	if r.blobs == "" {
+		return operation{}, fmt.Errorf("recording for %q references blob %s, but no blob directory is configured (see WithBlobs)",
+			op.command, op.blob)
+	}
+
+	output, err := ioutil.ReadFile(filepath.Join(r.blobs, strings.TrimPrefix(op.blob, blobPrefix)))
+	if err != nil {
+		return operation{}, fmt.Errorf("unable to read blob for %q: %v\n\n%s", op.command, err, hint)
+	}
+	op.output = string(output)
+	op.blob = ""
+	return op, nil
+}
+
+// isBlobRef returns whether the given string is a well-formed reference to a
+// blob.
+func isBlobRef(ref string) bool {
+	digest := strings.TrimPrefix(ref, blobPrefix)
+	if digest == ref || len(digest) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(digest)
+	return err == nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package recorder
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecorderBlobs(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "recording.blobs")
+	large := strings.Repeat("large output\n", 10)
+
+	buffer := bytes.NewBuffer(nil)
+	recorder := New(WithRecording(buffer), WithBlobs(dir), WithBlobThreshold(64))
+	for _, command := range []string{"command-a", "command-b", "command-c"} {
+		output := large
+		if command == "command-b" {
+			output = "small output\n"
+		}
+		_, err := recorder.Next(command, func() (string, error) {
+			return output, nil
+		})
+		require.NoError(t, err)
+	}
+
+	// Identical outputs share a blob.
+	require.Equal(t, 2, strings.Count(buffer.String(), "---- blob sha256:"))
+	require.Contains(t, buffer.String(), "command-b\n----\nsmall output\n")
+	blobs, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, blobs, 1)
+
+	replayer := New(WithReplay(bytes.NewReader(buffer.Bytes()), "recording"), WithBlobs(dir))
+	for _, command := range []string{"command-a", "command-b", "command-c"} {
+		output, err := replayer.Next(command, nil)
+		require.NoError(t, err)
+		if command == "command-b" {
+			require.Equal(t, "small output\n", output)
+		} else {
+			require.Equal(t, large, output)
+		}
+	}
+
+	// Blobs are required to replay operations that reference them.
+	replayer = New(WithReplay(bytes.NewReader(buffer.Bytes()), "recording"))
+	_, err = replayer.Next("command-a", nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no blob directory is configured")
+
+	replayer = New(WithReplay(strings.NewReader("command\n---- blob sha256:abc\n"), "recording"))
+	_, err = replayer.Next("command", nil)
+	var parseErr *ParseError
+	require.True(t, errors.As(err, &parseErr))
+	require.Equal(t, 2, parseErr.Line)
+}
@@ -0,0 +1,572 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Command recorder is a tool for working with recording files.
+//
+//   recorder fmt [-l] [-w] [-format text|jsonl] [files...]
+//   recorder lint [-format text|jsonl] [files...]
+//   recorder cat [-format text|jsonl] [files...]
+//   recorder ls [-format text|jsonl] [files...]
+//   recorder grep [-command] [-output] [-i] [-format text|jsonl] <pattern> [files...]
+//   recorder stats [-format text|jsonl] [files...]
+//   recorder convert [-from text|jsonl] [-to text|jsonl] [-o file] [file]
+//
+// Recordings are read from stdin if no files are specified. The format of a
+// recording is inferred from its file name (recordings ending in .jsonl, or
+// .jsonl.gz, etc., are in the JSON Lines format), unless specified explicitly.
+// Compressed recordings (gzip or zstd) are decompressed transparently; cat in
+// particular can be used to view them, or to diff them as text:
+//
+//   $ git config diff.recording.textconv 'recorder cat'
+//
+// It uses the same parser tests do, so its behaviour never drifts from what
+// tests see.
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/irfansharif/recorder"
+	"github.com/klauspost/compress/zstd"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+const usage = `recorder is a tool for working with recording files.
+
+Usage:
+
+	recorder <command> [arguments]
+
+The commands are:
+
+	fmt      canonicalize recordings
+	lint     report all errors found in recordings
+	cat      print recordings in the text format
+	ls       list operations in recordings, with their line numbers
+	grep     search for operations whose commands or outputs match a pattern
+	stats    print statistics about recordings
+	convert  convert a recording between formats
+
+Use "recorder <command> -h" for more information about a command.
+`
+
+// exit codes.
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+// run runs the tool with the given arguments, returning its exit code.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+
+	cmds := map[string]func(*env, []string) int{
+		"fmt":     (*env).fmt,
+		"lint":    (*env).lint,
+		"cat":     (*env).cat,
+		"ls":      (*env).ls,
+		"grep":    (*env).grep,
+		"stats":   (*env).stats,
+		"convert": (*env).convert,
+	}
+	cmd, ok := cmds[args[0]]
+	if !ok {
+		if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+			fmt.Fprint(stdout, usage)
+			return exitOK
+		}
+		fmt.Fprintf(stderr, "recorder: unknown command %q\n\n%s", args[0], usage)
+		return exitUsage
+	}
+
+	e := &env{name: args[0], stdin: stdin, stdout: stdout, stderr: stderr}
+	return cmd(e, args[1:])
+}
+
+// env is the environment commands are run in.
+type env struct {
+	name           string // name of the command being run
+	stdin          io.Reader
+	stdout, stderr io.Writer
+}
+
+// flags returns a new flag set for the command being run.
+func (e *env) flags(usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(e.name, flag.ContinueOnError)
+	fs.SetOutput(e.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(e.stderr, "usage: recorder %s %s\n", e.name, usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// errorf reports the given error.
+func (e *env) errorf(format string, args ...interface{}) {
+	fmt.Fprintf(e.stderr, "recorder %s: %s\n", e.name, fmt.Sprintf(format, args...))
+}
+
+// recording is a recording file read in by the tool.
+type recording struct {
+	name        string
+	data        []byte // decompressed contents
+	format      recorder.Format
+	compression string // gzip or zstd, if compressed
+}
+
+// reader returns a reader for the (decompressed) recording.
+func (r *recording) reader() io.Reader {
+	return bytes.NewReader(r.data)
+}
+
+// each invokes the given callback for every operation in the recording.
+func (r *recording) each(fn func(recorder.Operation)) error {
+	decoder := recorder.NewDecoder(r.reader(), r.name, r.format)
+	for {
+		op, err := decoder.Decode()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fn(op)
+	}
+}
+
+// read reads in the recordings at the given paths, or from stdin if none are
+// specified. If the given format is empty, it's inferred from the file name.
+func (e *env) read(paths []string, format string) ([]*recording, error) {
+	if len(paths) == 0 {
+		data, err := ioutil.ReadAll(e.stdin)
+		if err != nil {
+			return nil, err
+		}
+		rec, err := newRecording("<stdin>", data, format)
+		if err != nil {
+			return nil, err
+		}
+		return []*recording{rec}, nil
+	}
+
+	var recs []*recording
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		rec, err := newRecording(path, data, format)
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+func newRecording(name string, data []byte, format string) (*recording, error) {
+	if format == "" {
+		format = formatFor(name)
+	}
+	f, err := parseFormat(format)
+	if err != nil {
+		return nil, err
+	}
+
+	// Compressed recordings are detected the same way Recorders do.
+	reader, compression, err := recorder.Decompress(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	rec := &recording{name: name, format: f, compression: compression}
+	if rec.data, err = ioutil.ReadAll(reader); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return rec, nil
+}
+
+// formatFor infers the format of the recording with the given file name.
+func formatFor(name string) string {
+	if compressionFor(name) != "" {
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	if strings.HasSuffix(name, ".jsonl") {
+		return "jsonl"
+	}
+	return "text"
+}
+
+// compressionFor infers what the recording with the given file name is to be
+// compressed with, if anything.
+func compressionFor(name string) string {
+	switch filepath.Ext(name) {
+	case ".gz":
+		return "gzip"
+	case ".zst":
+		return "zstd"
+	default:
+		return ""
+	}
+}
+
+// parseFormat returns the recorder.Format with the given name.
+func parseFormat(name string) (recorder.Format, error) {
+	switch name {
+	case "text":
+		return recorder.TextFormat(), nil
+	case "jsonl":
+		return recorder.JSONLFormat(), nil
+	default:
+		return nil, fmt.Errorf("unknown format %q (expected text or jsonl)", name)
+	}
+}
+
+// fmt canonicalizes recordings, printing them out (or rewriting them in place).
+func (e *env) fmt(args []string) int {
+	fs := e.flags("[-l] [-w] [-format text|jsonl] [files...]")
+	list := fs.Bool("l", false, "list files whose formatting differs from the canonical form")
+	write := fs.Bool("w", false, "write result to (source) file instead of stdout")
+	format := fs.String("format", "", "format of the recordings (inferred from file names by default)")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *write && fs.NArg() == 0 {
+		e.errorf("cannot use -w with standard input")
+		return exitUsage
+	}
+
+	recs, err := e.read(fs.Args(), *format)
+	if err != nil {
+		e.errorf("%v", err)
+		return exitFailure
+	}
+
+	code := exitOK
+	for _, rec := range recs {
+		var buf bytes.Buffer
+		if err := recorder.Convert(rec.reader(), rec.name, rec.format, &buf, rec.format); err != nil {
+			e.errorf("%v", err)
+			code = exitFailure
+			continue
+		}
+		formatted := buf.Bytes()
+
+		if *list && !bytes.Equal(rec.data, formatted) {
+			fmt.Fprintln(e.stdout, rec.name)
+		}
+		if *write && !bytes.Equal(rec.data, formatted) {
+			if err := writeFile(rec.name, formatted, rec.compression); err != nil {
+				e.errorf("%v", err)
+				code = exitFailure
+			}
+		}
+		if !*list && !*write {
+			e.stdout.Write(formatted)
+		}
+	}
+	return code
+}
+
+// lint reports all errors found in recordings.
+func (e *env) lint(args []string) int {
+	fs := e.flags("[-format text|jsonl] [files...]")
+	format := fs.String("format", "", "format of the recordings (inferred from file names by default)")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	recs, err := e.read(fs.Args(), *format)
+	if err != nil {
+		e.errorf("%v", err)
+		return exitFailure
+	}
+
+	code := exitOK
+	for _, rec := range recs {
+		for _, err := range recorder.Lint(rec.reader(), rec.name, rec.format) {
+			fmt.Fprintln(e.stdout, err)
+			code = exitFailure
+		}
+	}
+	return code
+}
+
+// cat prints recordings in the text format.
+func (e *env) cat(args []string) int {
+	fs := e.flags("[-format text|jsonl] [files...]")
+	format := fs.String("format", "", "format of the recordings (inferred from file names by default)")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	recs, err := e.read(fs.Args(), *format)
+	if err != nil {
+		e.errorf("%v", err)
+		return exitFailure
+	}
+
+	for _, rec := range recs {
+		if err := recorder.Convert(rec.reader(), rec.name, rec.format, e.stdout, recorder.TextFormat()); err != nil {
+			e.errorf("%v", err)
+			return exitFailure
+		}
+	}
+	return exitOK
+}
+
+// ls lists the operations in recordings, along with their line numbers.
+func (e *env) ls(args []string) int {
+	fs := e.flags("[-format text|jsonl] [files...]")
+	format := fs.String("format", "", "format of the recordings (inferred from file names by default)")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	recs, err := e.read(fs.Args(), *format)
+	if err != nil {
+		e.errorf("%v", err)
+		return exitFailure
+	}
+
+	for _, rec := range recs {
+		if err := rec.each(func(op recorder.Operation) {
+			fmt.Fprintf(e.stdout, "%s:%d: %s%s\n", op.Name, op.Line, op.Command, errorSuffix(op.Error))
+		}); err != nil {
+			e.errorf("%v", err)
+			return exitFailure
+		}
+	}
+	return exitOK
+}
+
+// errorSuffix annotates operations that recorded errors.
+func errorSuffix(isError bool) string {
+	if isError {
+		return " (error)"
+	}
+	return ""
+}
+
+// grep searches for operations whose commands or outputs match a pattern.
+func (e *env) grep(args []string) int {
+	fs := e.flags("[-command] [-output] [-i] [-format text|jsonl] <pattern> [files...]")
+	commandOnly := fs.Bool("command", false, "only search commands")
+	outputOnly := fs.Bool("output", false, "only search outputs")
+	ignoreCase := fs.Bool("i", false, "match case-insensitively")
+	format := fs.String("format", "", "format of the recordings (inferred from file names by default)")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	pattern := fs.Arg(0)
+	if *ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		e.errorf("%v", err)
+		return exitUsage
+	}
+	searchCommands := !*outputOnly || *commandOnly
+	searchOutputs := !*commandOnly || *outputOnly
+
+	recs, err := e.read(fs.Args()[1:], *format)
+	if err != nil {
+		e.errorf("%v", err)
+		return exitFailure
+	}
+
+	matched := false
+	for _, rec := range recs {
+		if err := rec.each(func(op recorder.Operation) {
+			var lines []string
+			if searchOutputs {
+				for _, l := range strings.SplitAfter(op.Output, "\n") {
+					if l != "" && re.MatchString(l) {
+						lines = append(lines, strings.TrimSuffix(l, "\n"))
+					}
+				}
+			}
+			if len(lines) == 0 && !(searchCommands && re.MatchString(op.Command)) {
+				return
+			}
+
+			matched = true
+			fmt.Fprintf(e.stdout, "%s:%d: %s%s\n", op.Name, op.Line, op.Command, errorSuffix(op.Error))
+			for _, l := range lines {
+				fmt.Fprintf(e.stdout, "\t%s\n", l)
+			}
+		}); err != nil {
+			e.errorf("%v", err)
+			return exitFailure
+		}
+	}
+	if !matched {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// stats prints statistics about recordings.
+func (e *env) stats(args []string) int {
+	fs := e.flags("[-format text|jsonl] [files...]")
+	format := fs.String("format", "", "format of the recordings (inferred from file names by default)")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	recs, err := e.read(fs.Args(), *format)
+	if err != nil {
+		e.errorf("%v", err)
+		return exitFailure
+	}
+
+	for _, rec := range recs {
+		var ops, errs, size, largest, largestLine int
+		var largestCommand string
+		commands := make(map[string]int)
+		if err := rec.each(func(op recorder.Operation) {
+			ops++
+			if op.Error {
+				errs++
+			}
+			commands[op.Command]++
+			size += len(op.Output)
+			if len(op.Output) > largest {
+				largest, largestLine, largestCommand = len(op.Output), op.Line, op.Command
+			}
+		}); err != nil {
+			e.errorf("%v", err)
+			return exitFailure
+		}
+
+		fmt.Fprintf(e.stdout, "%s:\n", rec.name)
+		fmt.Fprintf(e.stdout, "  operations:        %d (%d error(s))\n", ops, errs)
+		fmt.Fprintf(e.stdout, "  distinct commands: %d\n", len(commands))
+		fmt.Fprintf(e.stdout, "  output bytes:      %d\n", size)
+		if ops > 0 {
+			fmt.Fprintf(e.stdout, "  largest output:    %d bytes (%s:%d: %s)\n", largest, rec.name, largestLine, largestCommand)
+		}
+
+		var repeated []string
+		for command, count := range commands {
+			if count > 1 {
+				repeated = append(repeated, command)
+			}
+		}
+		sort.Strings(repeated)
+		for _, command := range repeated {
+			fmt.Fprintf(e.stdout, "  repeated command:  %s (%d times)\n", command, commands[command])
+		}
+	}
+	return exitOK
+}
+
+// convert converts a recording between formats.
+func (e *env) convert(args []string) int {
+	fs := e.flags("[-from text|jsonl] [-to text|jsonl] [-o file] [file]")
+	from := fs.String("from", "", "format of the recording (inferred from the file name by default)")
+	to := fs.String("to", "", "format to convert to (inferred from the -o file name by default)")
+	out := fs.String("o", "", "write result to the given file instead of stdout (compressed if it ends in .gz or .zst)")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	if *to == "" {
+		if *out == "" {
+			e.errorf("-to is required when writing to stdout")
+			return exitUsage
+		}
+		*to = formatFor(*out)
+	}
+	toFormat, err := parseFormat(*to)
+	if err != nil {
+		e.errorf("%v", err)
+		return exitUsage
+	}
+
+	recs, err := e.read(fs.Args(), *from)
+	if err != nil {
+		e.errorf("%v", err)
+		return exitFailure
+	}
+	rec := recs[0]
+
+	var buf bytes.Buffer
+	if err := recorder.Convert(rec.reader(), rec.name, rec.format, &buf, toFormat); err != nil {
+		e.errorf("%v", err)
+		return exitFailure
+	}
+	if *out == "" {
+		e.stdout.Write(buf.Bytes())
+		return exitOK
+	}
+	if err := writeFile(*out, buf.Bytes(), compressionFor(*out)); err != nil {
+		e.errorf("%v", err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// writeFile writes the given data to the file at the given path, compressing it
+// using gzip or zstd if asked for.
+func writeFile(path string, data []byte, compression string) error {
+	if compression != "" {
+		var buf bytes.Buffer
+		var writer io.WriteCloser = gzip.NewWriter(&buf)
+		if compression == "zstd" {
+			writer, _ = zstd.NewWriter(&buf) // errors only for invalid options
+		}
+		if _, err := writer.Write(data); err != nil {
+			return err
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return ioutil.WriteFile(path, data, mode)
+}
@@ -0,0 +1,228 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testRecording = `
+# comment
+command-a
+----
+output-a
+
+command-b
+---- error
+output-b
+
+command-a
+----
+----
+output-c
+
+output-d
+----
+----
+`
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "recording")
+	require.NoError(t, ioutil.WriteFile(path, []byte(testRecording), 0644))
+
+	for _, tc := range []struct {
+		args     []string
+		stdin    string
+		code     int
+		expected string
+	}{
+		{
+			args: []string{"ls", path},
+			expected: `
+$DIR/recording:3: command-a
+$DIR/recording:7: command-b (error)
+$DIR/recording:11: command-a
+`,
+		},
+		{
+			args: []string{"grep", "output-[bd]", path},
+			expected: `
+$DIR/recording:7: command-b (error)
+	output-b
+$DIR/recording:11: command-a
+	output-d
+`,
+		},
+		{
+			args: []string{"grep", "-command", "output", path},
+			code: exitFailure,
+		},
+		{
+			args: []string{"stats", path},
+			expected: `
+$DIR/recording:
+  operations:        3 (1 error(s))
+  distinct commands: 2
+  output bytes:      37
+  largest output:    19 bytes ($DIR/recording:11: command-a)
+  repeated command:  command-a (2 times)
+`,
+		},
+		{
+			args:  []string{"fmt"},
+			stdin: "command\n----\n----\noutput\n----\n----\n",
+			expected: `
+command
+----
+output
+
+`,
+		},
+		{
+			// Comments that aren't attached to operations are retained.
+			args:  []string{"fmt"},
+			stdin: "# Recording of the globber.\n\n\n# keep\ncommand\n----\noutput\n\n# trailing\n\n# notes",
+			expected: `
+# Recording of the globber.
+
+# keep
+command
+----
+output
+
+# trailing
+
+# notes
+`,
+		},
+		{
+			args:  []string{"convert", "-to", "jsonl"},
+			stdin: "# header\n\ncommand\n----\noutput\n\n# trailing\n",
+			expected: `
+{"command":"command","output":"output\n","detached":["# header"]}
+{"detached":["# trailing"]}
+`,
+		},
+		{
+			args:  []string{"fmt", "-l", path},
+			code:  exitOK,
+			stdin: "",
+			expected: `
+$DIR/recording
+`,
+		},
+		{
+			args:  []string{"lint"},
+			stdin: "command-a\n---\n\ncommand-b\n----\n----\noutput\n",
+			code:  exitFailure,
+			expected: `
+<stdin>:2: expected to find separator after command, found "---" instead
+<stdin>:7: missing closing double ---- separators
+`,
+		},
+		{
+			args:  []string{"convert", "-to", "jsonl"},
+			stdin: "# keep\ncommand\n----\noutput\n",
+			expected: `
+{"command":"command","output":"output\n","comments":["# keep"]}
+`,
+		},
+		{
+			args:  []string{"cat", "-format", "jsonl"},
+			stdin: `{"command":"command","output":"output\n"}`,
+			expected: `
+command
+----
+output
+
+`,
+		},
+		{
+			args: []string{"unknown"},
+			code: exitUsage,
+		},
+	} {
+		t.Run(strings.Join(tc.args, " "), func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := run(tc.args, strings.NewReader(tc.stdin), &stdout, &stderr)
+			require.Equal(t, tc.code, code, stderr.String())
+			if tc.expected != "" {
+				expected := strings.ReplaceAll(strings.TrimLeft(tc.expected, "\n"), "$DIR", dir)
+				require.Equal(t, expected, stdout.String())
+			}
+		})
+	}
+}
+
+func TestFmtWrite(t *testing.T) {
+	for _, tc := range []struct {
+		ext   string
+		magic []byte
+	}{
+		{".gz", []byte{0x1f, 0x8b}},
+		{".zst", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	} {
+		t.Run(tc.ext, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "recording.jsonl"+tc.ext)
+
+			var stdout, stderr bytes.Buffer
+			code := run([]string{"convert", "-o", path}, strings.NewReader(testRecording), &stdout, &stderr)
+			require.Equal(t, exitOK, code, stderr.String())
+
+			// The converted recording is compressed, and can be viewed using cat.
+			data, err := ioutil.ReadFile(path)
+			require.NoError(t, err)
+			require.True(t, bytes.HasPrefix(data, tc.magic))
+
+			code = run([]string{"cat", path}, nil, &stdout, &stderr)
+			require.Equal(t, exitOK, code, stderr.String())
+			expected := `
+# comment
+command-a
+----
+output-a
+
+command-b
+---- error
+output-b
+
+command-a
+----
+----
+output-c
+
+output-d
+----
+----
+
+`
+			require.Equal(t, strings.TrimLeft(expected, "\n"), stdout.String())
+
+			// Canonical recordings are left as is.
+			code = run([]string{"fmt", "-w", "-l", path}, nil, &stdout, &stderr)
+			require.Equal(t, exitOK, code, stderr.String())
+			after, err := ioutil.ReadFile(path)
+			require.NoError(t, err)
+			require.Equal(t, data, after)
+		})
+	}
+}
@@ -0,0 +1,547 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package recorder
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Codec converts values of type T to and from the string form Recorders
+// understand. Implementations guarantee that decoding an encoded value
+// produces the original value, and that encoded values survive a round trip
+// through a recording.
+type Codec[T any] interface {
+	Encode(T) (string, error)
+	Decode(string) (T, error)
+}
+
+// Call is a typed variant of Next, built on top of Do. It invokes the given
+// function with the given input, recording or replaying its result depending
+// on how the Recorder is configured (see Next). The command is derived from
+// the input: strings are used as is, otherwise it's the input's
+// fmt.Stringer/encoding.TextMarshaler form, falling back to its default
+// formatting. The codec is used to convert the result to and from its
+// recorded form.
+//
+//      func (g *globber) glob(pattern string) ([]string, error) {
+//          return recorder.Call(g.Recorder, pattern, filepath.Glob, recorder.Strings())
+//      }
+func Call[In, Out any](r *Recorder, in In, fn func(In) (Out, error), codec Codec[Out]) (Out, error) {
+	if r != nil && r.reporter != nil {
+		r.reporter.Helper()
+	}
+	return Do(r, commandFor(in), func() (Out, error) {
+		return fn(in)
+	}, codec.Encode, codec.Decode)
+}
+
+// commandFor derives a command from the given input (see Call).
+func commandFor(in interface{}) string {
+	switch v := in.(type) {
+	case string:
+		return v
+	case fmt.Stringer:
+		return v.String()
+	case encoding.TextMarshaler:
+		if text, err := v.MarshalText(); err == nil {
+			return string(text)
+		}
+	}
+	return fmt.Sprint(in)
+}
+
+// Strings returns a Codec for string slices. Each element is recorded on its
+// own line, quoted (using Go syntax) only if it would otherwise be ambiguous:
+// empty strings, strings with leading/trailing whitespace, strings spanning
+// multiple lines, etc. Nil and empty slices are recorded identically, and
+// decode to nil.
+func Strings() Codec[[]string] {
+	return stringsCodec{}
+}
+
+type stringsCodec struct{}
+
+var _ Codec[[]string] = stringsCodec{}
+
+// Encode implements the Codec interface.
+func (stringsCodec) Encode(v []string) (string, error) {
+	var sb strings.Builder
+	for _, elem := range v {
+		if needsQuoting(elem) {
+			elem = strconv.Quote(elem)
+		}
+		sb.WriteString(elem)
+		sb.WriteString("\n")
+	}
+	return sb.String(), nil
+}
+
+// Decode implements the Codec interface.
+func (stringsCodec) Decode(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var v []string
+	for _, line := range strings.Split(strings.TrimSuffix(s, "\n"), "\n") {
+		if strings.HasPrefix(line, `"`) {
+			unquoted, err := strconv.Unquote(line)
+			if err != nil {
+				return nil, fmt.Errorf("unable to decode %s: %v", line, err)
+			}
+			line = unquoted
+		}
+		v = append(v, line)
+	}
+	return v, nil
+}
+
+// needsQuoting returns whether the given string, when recorded as a line of
+// its own, would be ambiguous or not survive a round trip through the
+// recording.
+func needsQuoting(s string) bool {
+	if s == "" || s == "----" || s != strings.TrimSpace(s) || strings.HasPrefix(s, `"`) {
+		return true
+	}
+	if !utf8.ValidString(s) {
+		return true
+	}
+	return strings.IndexFunc(s, func(r rune) bool {
+		return !unicode.IsPrint(r)
+	}) >= 0
+}
+
+// Text returns a Codec for line-oriented text. Text is recorded as is, unless
+// doing so would not survive a round trip through the recording (text that's
+// not newline terminated, or contains whitespace-only lines, etc.), in which
+// case it's recorded as a single quoted (using Go syntax) string.
+func Text() Codec[string] {
+	return textCodec{}
+}
+
+type textCodec struct{}
+
+var _ Codec[string] = textCodec{}
+
+// Encode implements the Codec interface.
+func (textCodec) Encode(s string) (string, error) {
+	if s == "" || isSafeText(s) {
+		return s, nil
+	}
+	return strconv.Quote(s) + "\n", nil
+}
+
+// Decode implements the Codec interface.
+func (textCodec) Decode(s string) (string, error) {
+	if !strings.HasPrefix(s, `"`) {
+		return s, nil
+	}
+
+	unquoted, err := strconv.Unquote(strings.TrimSuffix(s, "\n"))
+	if err != nil {
+		return "", fmt.Errorf("unable to decode %s: %v", s, err)
+	}
+	return unquoted, nil
+}
+
+// isSafeText returns whether the given text survives a round trip through the
+// recording as is, and is not ambiguous with its quoted form.
+func isSafeText(s string) bool {
+	if !strings.HasSuffix(s, "\n") || strings.HasSuffix(s, "\n\n") {
+		return false
+	}
+	if strings.HasPrefix(s, `"`) || !utf8.ValidString(s) {
+		return false
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(s, "\n"), "\n") {
+		if line == "" {
+			continue // blank lines are fine, whitespace-only ones are not
+		}
+		if strings.TrimSpace(line) == "" || line == "----" || strings.HasSuffix(line, "\r") {
+			return false
+		}
+	}
+	return true
+}
+
+// JSON returns a Codec for values of type T, recorded in their (indented) JSON
+// form. See encoding/json for how values are converted.
+func JSON[T any]() Codec[T] {
+	return jsonCodec[T]{}
+}
+
+type jsonCodec[T any] struct{}
+
+// Encode implements the Codec interface.
+func (jsonCodec[T]) Encode(v T) (string, error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data) + "\n", nil
+}
+
+// Decode implements the Codec interface.
+func (jsonCodec[T]) Decode(s string) (T, error) {
+	var v T
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return v, err
+	}
+	return v, nil
+}
+
+// TextMarshaler returns a Codec for values of type T that implement
+// encoding.TextMarshaler (and whose pointers implement
+// encoding.TextUnmarshaler), recorded in their text form (see Text).
+//
+//      codec := recorder.TextMarshaler[netip.Addr]()
+func TextMarshaler[T encoding.TextMarshaler, PT interface {
+	*T
+	encoding.TextUnmarshaler
+}]() Codec[T] {
+	return textMarshalerCodec[T, PT]{}
+}
+
+type textMarshalerCodec[T encoding.TextMarshaler, PT interface {
+	*T
+	encoding.TextUnmarshaler
+}] struct{}
+
+// Encode implements the Codec interface.
+func (textMarshalerCodec[T, PT]) Encode(v T) (string, error) {
+	text, err := v.MarshalText()
+	if err != nil {
+		return "", err
+	}
+	return textCodec{}.Encode(string(text))
+}
+
+// Decode implements the Codec interface.
+func (textMarshalerCodec[T, PT]) Decode(s string) (T, error) {
+	var v T
+	text, err := textCodec{}.Decode(s)
+	if err != nil {
+		return v, err
+	}
+	if err := PT(&v).UnmarshalText([]byte(text)); err != nil {
+		return v, err
+	}
+	return v, nil
+}
+
+// FileInfo returns a Codec for fs.FileInfo, recorded in its structured form
+// (see Command):
+//
+//      file name=go.mod size=34 mode=-rw-r--r-- modtime=2021-03-12T11:51:30Z
+//
+// Decoded values are indistinguishable from the original, with the exception of
+// Sys, which always returns nil.
+func FileInfo() Codec[fs.FileInfo] {
+	return fileInfoCodec{}
+}
+
+type fileInfoCodec struct{}
+
+var _ Codec[fs.FileInfo] = fileInfoCodec{}
+
+// Encode implements the Codec interface.
+func (fileInfoCodec) Encode(info fs.FileInfo) (string, error) {
+	return encodeFileInfo(info).String() + "\n", nil
+}
+
+// Decode implements the Codec interface.
+func (fileInfoCodec) Decode(s string) (fs.FileInfo, error) {
+	return decodeFileInfo(strings.TrimSuffix(s, "\n"))
+}
+
+// DirEntries returns a Codec for directory listings (see fs.ReadDir). Each
+// entry's file info is recorded on its own line, as with FileInfo. Nil and
+// empty listings are recorded identically, and decode to nil.
+func DirEntries() Codec[[]fs.DirEntry] {
+	return dirEntriesCodec{}
+}
+
+type dirEntriesCodec struct{}
+
+var _ Codec[[]fs.DirEntry] = dirEntriesCodec{}
+
+// Encode implements the Codec interface.
+func (dirEntriesCodec) Encode(entries []fs.DirEntry) (string, error) {
+	var sb strings.Builder
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(encodeFileInfo(info).String())
+		sb.WriteString("\n")
+	}
+	return sb.String(), nil
+}
+
+// Decode implements the Codec interface.
+func (dirEntriesCodec) Decode(s string) ([]fs.DirEntry, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var entries []fs.DirEntry
+	for _, line := range strings.Split(strings.TrimSuffix(s, "\n"), "\n") {
+		info, err := decodeFileInfo(line)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	return entries, nil
+}
+
+// encodeFileInfo returns the structured form of the given file info.
+func encodeFileInfo(info fs.FileInfo) Command {
+	return Cmd("file",
+		KV("name", info.Name()),
+		KV("size", strconv.FormatInt(info.Size(), 10)),
+		KV("mode", info.Mode().String()),
+		KV("modtime", info.ModTime().Format(time.RFC3339Nano)),
+	)
+}
+
+// decodeFileInfo is the inverse of encodeFileInfo.
+func decodeFileInfo(s string) (fs.FileInfo, error) {
+	cmd, err := ParseCommand(s)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode file info: %v", err)
+	}
+	if cmd.Name != "file" {
+		return nil, fmt.Errorf("unable to decode file info: unexpected %q", cmd.Name)
+	}
+
+	var info fileInfo
+	info.name = cmd.Val("name")
+	if info.size, err = strconv.ParseInt(cmd.Val("size"), 10, 64); err != nil {
+		return nil, fmt.Errorf("unable to decode file info: %v", err)
+	}
+	if info.mode, err = parseFileMode(cmd.Val("mode")); err != nil {
+		return nil, fmt.Errorf("unable to decode file info: %v", err)
+	}
+	if info.modTime, err = time.Parse(time.RFC3339Nano, cmd.Val("modtime")); err != nil {
+		return nil, fmt.Errorf("unable to decode file info: %v", err)
+	}
+	return info, nil
+}
+
+// fileInfo is the decoded form of fs.FileInfo.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+var _ fs.FileInfo = fileInfo{}
+
+// Name implements the fs.FileInfo interface.
+func (i fileInfo) Name() string { return i.name }
+
+// Size implements the fs.FileInfo interface.
+func (i fileInfo) Size() int64 { return i.size }
+
+// Mode implements the fs.FileInfo interface.
+func (i fileInfo) Mode() fs.FileMode { return i.mode }
+
+// ModTime implements the fs.FileInfo interface.
+func (i fileInfo) ModTime() time.Time { return i.modTime }
+
+// IsDir implements the fs.FileInfo interface.
+func (i fileInfo) IsDir() bool { return i.mode.IsDir() }
+
+// Sys implements the fs.FileInfo interface. It always returns nil.
+func (i fileInfo) Sys() interface{} { return nil }
+
+// fileModeTypes are the characters fs.FileMode.String uses for each of its
+// type bits, starting from the most significant one.
+const fileModeTypes = "dalTLDpSugct?"
+
+// parseFileMode is the inverse of fs.FileMode.String.
+func parseFileMode(s string) (fs.FileMode, error) {
+	const perms = "rwxrwxrwx"
+	if len(s) < 1+len(perms) {
+		return 0, fmt.Errorf("invalid mode %q", s)
+	}
+
+	var mode fs.FileMode
+	types, rwx := s[:len(s)-len(perms)], s[len(s)-len(perms):]
+	if types != "-" {
+		for _, c := range types {
+			i := strings.IndexRune(fileModeTypes, c)
+			if i < 0 {
+				return 0, fmt.Errorf("invalid mode %q", s)
+			}
+			mode |= 1 << (32 - 1 - i)
+		}
+	}
+	for i, c := range rwx {
+		switch c {
+		case '-':
+		case rune(perms[i]):
+			mode |= 1 << (len(perms) - 1 - i)
+		default:
+			return 0, fmt.Errorf("invalid mode %q", s)
+		}
+	}
+	return mode, nil
+}
+
+// Errors returns a Codec for errors returned by the filesystem operation with
+// the given command, recorded in their structured form (see Command):
+//
+//      path-error op=open err="no such file or directory" is="file does not exist"
+//      link-error op=rename new=b err="file exists" is="file already exists"
+//      error err="syntax error in pattern"
+//
+// Paths are omitted if they're the same as the command's (under the path, old
+// and new keys), keeping them out of the recording. "is" is only included if
+// the error matches one of fs.ErrNotExist, fs.ErrExist, etc. without being
+// identical to it. Decoded errors are *fs.PathErrors and *os.LinkErrors
+// wrapping the syscall error with the recorded message, if there's one (and it
+// matches the same error), or an error that matches the same fs.ErrNotExist
+// (etc.) error as the original otherwise. Messages that aren't in the
+// structured form are decoded as plain errors.
+func Errors(cmd Command) Codec[error] {
+	return errorCodec{cmd: cmd}
+}
+
+type errorCodec struct {
+	cmd Command
+}
+
+var _ Codec[error] = errorCodec{}
+
+// Encode implements the Codec interface.
+func (c errorCodec) Encode(err error) (string, error) {
+	return encodeError(err, c.cmd).String(), nil
+}
+
+// Decode implements the Codec interface.
+func (c errorCodec) Decode(s string) (error, error) {
+	return decodeError(strings.TrimSuffix(s, "\n"), c.cmd), nil
+}
+
+// fsErrors are the errors we expect filesystem errors to match (using
+// errors.Is). They're recorded alongside the error, so that decoded errors
+// match them too.
+var fsErrors = []error{
+	fs.ErrInvalid, fs.ErrPermission, fs.ErrExist, fs.ErrNotExist, fs.ErrClosed, path.ErrBadPattern,
+}
+
+// encodeError returns the structured form of the given error, as returned by
+// the operation with the given command.
+func encodeError(err error, cmd Command) Command {
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	switch {
+	case errors.As(err, &pathErr):
+		args := []Arg{KV("op", pathErr.Op)}
+		args = append(args, errorPathArgs(cmd, "path", pathErr.Path)...)
+		return Cmd("path-error", append(args, errorArgs(pathErr.Err)...)...)
+	case errors.As(err, &linkErr):
+		args := []Arg{KV("op", linkErr.Op)}
+		args = append(args, errorPathArgs(cmd, "old", linkErr.Old)...)
+		args = append(args, errorPathArgs(cmd, "new", linkErr.New)...)
+		return Cmd("link-error", append(args, errorArgs(linkErr.Err)...)...)
+	default:
+		return Cmd("error", errorArgs(err)...)
+	}
+}
+
+// errorPathArgs returns the argument for the given path, unless it's the same
+// as the command's.
+func errorPathArgs(cmd Command, key, path string) []Arg {
+	if arg, ok := cmd.Arg(key); ok && len(arg.Vals) == 1 && arg.Vals[0] == path {
+		return nil
+	}
+	return []Arg{KV(key, path)}
+}
+
+// errorArgs returns the arguments describing the given (underlying) error.
+func errorArgs(err error) []Arg {
+	args := []Arg{KV("err", err.Error())}
+	for _, target := range fsErrors {
+		if err != target && errors.Is(err, target) {
+			args = append(args, KV("is", target.Error()))
+			break
+		}
+	}
+	return args
+}
+
+// decodeError is the inverse of encodeError.
+func decodeError(msg string, cmd Command) error {
+	e, err := ParseCommand(msg)
+	if err != nil {
+		return errors.New(msg)
+	}
+	path := func(key string) string {
+		if _, ok := e.Arg(key); ok {
+			return e.Val(key)
+		}
+		return cmd.Val(key)
+	}
+
+	switch e.Name {
+	case "path-error":
+		return &fs.PathError{Op: e.Val("op"), Path: path("path"), Err: decodeErrorArgs(e)}
+	case "link-error":
+		return &os.LinkError{Op: e.Val("op"), Old: path("old"), New: path("new"), Err: decodeErrorArgs(e)}
+	case "error":
+		return decodeErrorArgs(e)
+	default:
+		return errors.New(msg)
+	}
+}
+
+// decodeErrorArgs is the inverse of errorArgs. Errors are mapped back to the
+// one of fsErrors with the same message, or failing that, the syscall error
+// with the same message that matches the recorded "is" error, if any.
+func decodeErrorArgs(e Command) error {
+	msg := e.Val("err")
+	var target error
+	for _, sentinel := range fsErrors {
+		if msg == sentinel.Error() {
+			return sentinel
+		}
+		if e.Val("is") == sentinel.Error() {
+			target = sentinel
+		}
+	}
+	if errno, ok := lookupErrno(msg); ok && (target == nil || errors.Is(errno, target)) {
+		return errno
+	}
+	if target != nil {
+		return &RecordedError{Msg: msg, sentinel: target}
+	}
+	return errors.New(msg)
+}
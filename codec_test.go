@@ -0,0 +1,164 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package recorder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// roundTrip records the given values using Call and the given codec, and then
+// plays them back, checking that they're unchanged.
+func roundTrip[T any](t *testing.T, codec Codec[T], values ...T) {
+	identity := func(i int) (T, error) {
+		return values[i], nil
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	recorder := New(WithRecording(buffer))
+	for i := range values {
+		_, err := Call(recorder, i, identity, codec)
+		require.NoError(t, err)
+	}
+
+	replayer := New(WithReplay(buffer, "recording"))
+	for i, expected := range values {
+		actual, err := Call(replayer, i, func(int) (T, error) {
+			t.Fatal("unexpected callback invocation when replaying")
+			return expected, nil
+		}, codec)
+		require.NoError(t, err)
+		require.Equal(t, expected, actual, fmt.Sprintf("value #%d", i))
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	t.Run("strings", func(t *testing.T) {
+		roundTrip(t, Strings(),
+			nil,
+			[]string{""},
+			[]string{"a", "b"},
+			[]string{"a", "", " b", "c\n", "----", `"quoted"`, "\t", "\xff"},
+		)
+	})
+
+	t.Run("text", func(t *testing.T) {
+		roundTrip(t, Text(),
+			"",
+			"a",
+			"a\n",
+			"a\n\nb\n",
+			"a\n\n",
+			"\na\n",
+			" \n",
+			"----\n",
+			`"quoted"`+"\n",
+			"crlf\r\n",
+		)
+	})
+
+	t.Run("json", func(t *testing.T) {
+		type object struct {
+			Name  string
+			Items []int
+		}
+		roundTrip(t, JSON[object](),
+			object{},
+			object{Name: "a\n\nb", Items: []int{1, 2, 3}},
+		)
+	})
+
+	t.Run("text-marshaler", func(t *testing.T) {
+		roundTrip(t, TextMarshaler[netip.Addr](),
+			netip.MustParseAddr("127.0.0.1"),
+			netip.MustParseAddr("::1"),
+		)
+	})
+
+	file := fileInfo{name: "go.mod", size: 34, mode: 0644, modTime: time.Date(2021, 3, 12, 11, 51, 30, 0, time.UTC)}
+	dir := fileInfo{name: "a dir", mode: 0755 | fs.ModeDir, modTime: time.Date(2021, 3, 12, 11, 51, 30, 5, time.UTC)}
+	t.Run("file-info", func(t *testing.T) {
+		roundTrip[fs.FileInfo](t, FileInfo(), file, dir)
+	})
+
+	t.Run("dir-entries", func(t *testing.T) {
+		roundTrip(t, DirEntries(),
+			nil,
+			[]fs.DirEntry{fs.FileInfoToDirEntry(file), fs.FileInfoToDirEntry(dir)},
+		)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		missing := filepath.Join(t.TempDir(), "missing")
+		_, openErr := os.Open(missing)
+		linkErr := os.Rename(missing, "elsewhere")
+		require.Error(t, openErr)
+		require.Error(t, linkErr)
+
+		codec := Errors(Cmd("open", KV("path", missing)))
+		roundTrip(t, codec, openErr, linkErr, fs.ErrNotExist, path.ErrBadPattern)
+
+		encoded, err := codec.Encode(openErr)
+		require.NoError(t, err)
+		require.Equal(t, `path-error op=open err="no such file or directory" is="file does not exist"`, encoded)
+
+		// Errors that don't map back to a syscall error still match the same
+		// fs.ErrNotExist (etc.) error as the original.
+		decoded, err := codec.Decode(`error err="gone fishing" is="file does not exist"`)
+		require.NoError(t, err)
+		require.EqualError(t, decoded, "gone fishing")
+		require.True(t, errors.Is(decoded, fs.ErrNotExist))
+
+		decoded, err = codec.Decode("not structured")
+		require.NoError(t, err)
+		require.Equal(t, errors.New("not structured"), decoded)
+	})
+}
+
+func TestParseFileMode(t *testing.T) {
+	for _, mode := range []fs.FileMode{
+		0, 0644, 0755 | fs.ModeDir, 0777 | fs.ModeSymlink, fs.ModeSetuid | fs.ModeSticky | 0750,
+		fs.ModeNamedPipe | fs.ModeSocket | fs.ModeDevice | fs.ModeCharDevice | fs.ModeIrregular,
+	} {
+		parsed, err := parseFileMode(mode.String())
+		require.NoError(t, err)
+		require.Equal(t, mode, parsed, mode.String())
+	}
+
+	for _, s := range []string{"", "rw-r--r--", "-rw-r--r-x-", "xrw-r--r--", "-rw-r--r-w"} {
+		_, err := parseFileMode(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestCallCommand(t *testing.T) {
+	buffer := bytes.NewBuffer(nil)
+	recorder := New(WithRecording(buffer))
+	_, err := Call(recorder, netip.MustParseAddr("127.0.0.1"), func(netip.Addr) (string, error) {
+		return "localhost\n", nil
+	}, Text())
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1\n----\nlocalhost\n\n", buffer.String())
+}
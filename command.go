@@ -0,0 +1,376 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package recorder
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Command is the (optional) structured form of a command, borrowed from
+// cockroachdb/datadriven. It consists of a name followed by a list of
+// arguments, each with a key and zero or more values:
+//
+//   <name> [<key>[=<value>|=(<value>[,<value>]...)]]...
+//
+// For example:
+//
+//   exec argv=(git,status) dir=/src/recorder verbose
+//
+// Names, keys and values that contain whitespace, backslashes or any of ,()="
+// (or are empty) are quoted using Go syntax, as are names starting with #.
+// Commands are still recorded and compared as plain strings, though recordings
+// wrap long ones over multiple lines, one argument per line (see the comment on
+// Recorder). See MatchCommands for matching commands structurally.
+type Command struct {
+	Name string
+	Args []Arg
+}
+
+// Arg is an argument to a Command.
+type Arg struct {
+	Key  string
+	Vals []string
+}
+
+// Cmd is a convenience constructor for Commands.
+func Cmd(name string, args ...Arg) Command {
+	return Command{Name: name, Args: args}
+}
+
+// KV is a convenience constructor for Args.
+func KV(key string, vals ...string) Arg {
+	return Arg{Key: key, Vals: vals}
+}
+
+// Arg returns the first argument with the given key, if any.
+func (c Command) Arg(key string) (Arg, bool) {
+	for _, arg := range c.Args {
+		if arg.Key == key {
+			return arg, true
+		}
+	}
+	return Arg{}, false
+}
+
+// Val returns the (first) value of the first argument with the given key, or
+// the empty string if there's none.
+func (c Command) Val(key string) string {
+	arg, ok := c.Arg(key)
+	if !ok || len(arg.Vals) == 0 {
+		return ""
+	}
+	return arg.Vals[0]
+}
+
+// String returns the printable form of the command, which can be parsed back
+// using ParseCommand.
+func (c Command) String() string {
+	var sb strings.Builder
+	sb.WriteString(c.name())
+	for _, arg := range c.Args {
+		sb.WriteString(" ")
+		sb.WriteString(arg.String())
+	}
+	return sb.String()
+}
+
+// name returns the printable form of the command's name.
+func (c Command) name() string {
+	if strings.HasPrefix(c.Name, "#") {
+		// Don't let it be mistaken for a comment.
+		return strconv.Quote(c.Name)
+	}
+	return quote(c.Name)
+}
+
+// String returns the printable form of the argument.
+func (a Arg) String() string {
+	var sb strings.Builder
+	sb.WriteString(quote(a.Key))
+	switch len(a.Vals) {
+	case 0:
+	case 1:
+		sb.WriteString("=")
+		sb.WriteString(quote(a.Vals[0]))
+	default:
+		sb.WriteString("=(")
+		for i, val := range a.Vals {
+			if i > 0 {
+				sb.WriteString(",")
+			}
+			sb.WriteString(quote(val))
+		}
+		sb.WriteString(")")
+	}
+	return sb.String()
+}
+
+// quote quotes the given name, key or value, if needed. Backslashes are
+// quoted too; a trailing one would otherwise wrap the command onto the next
+// line in recordings.
+func quote(s string) string {
+	if s == "" || !utf8.ValidString(s) || strings.IndexFunc(s, func(r rune) bool {
+		return isDelimiter(r) || r == '\\' || !unicode.IsPrint(r)
+	}) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// isDelimiter returns whether the given rune delimits names, keys and unquoted
+// values.
+func isDelimiter(r rune) bool {
+	return unicode.IsSpace(r) || strings.ContainsRune(`,()="`, r)
+}
+
+// ParseCommand parses the structured form of a command (see Command).
+func ParseCommand(s string) (Command, error) {
+	p := commandParser{s: s}
+	p.skipSpace()
+	name, ok, err := p.token()
+	if err != nil {
+		return Command{}, err
+	}
+	if !ok {
+		return Command{}, p.errorf("expected command name")
+	}
+
+	cmd := Command{Name: name}
+	for {
+		p.skipSpace()
+		if p.done() {
+			return cmd, nil
+		}
+
+		key, ok, err := p.token()
+		if err != nil {
+			return Command{}, err
+		}
+		if !ok {
+			return Command{}, p.errorf("expected argument key, found %q", p.s[p.pos])
+		}
+		arg := Arg{Key: key}
+		if p.consume('=') {
+			if p.consume('(') {
+				for {
+					p.skipSpace()
+					if p.consume(')') {
+						break
+					}
+					if len(arg.Vals) > 0 && !p.consume(',') {
+						return Command{}, p.errorf("expected ',' or ')' in list of values for %q", key)
+					}
+					p.skipSpace()
+					val, err := p.value()
+					if err != nil {
+						return Command{}, err
+					}
+					arg.Vals = append(arg.Vals, val)
+				}
+			} else {
+				val, err := p.value()
+				if err != nil {
+					return Command{}, err
+				}
+				arg.Vals = []string{val}
+			}
+		}
+		cmd.Args = append(cmd.Args, arg)
+	}
+}
+
+// commandParser is a tiny recursive-descent parser for Commands.
+type commandParser struct {
+	s   string
+	pos int
+}
+
+func (p *commandParser) done() bool {
+	return p.pos >= len(p.s)
+}
+
+// peek returns the next rune, and its width.
+func (p *commandParser) peek() (rune, int) {
+	return utf8.DecodeRuneInString(p.s[p.pos:])
+}
+
+func (p *commandParser) skipSpace() {
+	for !p.done() {
+		r, width := p.peek()
+		if !unicode.IsSpace(r) {
+			break
+		}
+		p.pos += width
+	}
+}
+
+func (p *commandParser) consume(c byte) bool {
+	if !p.done() && p.s[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// word parses out a run of non-delimiting characters.
+func (p *commandParser) word() string {
+	start := p.pos
+	for !p.done() {
+		r, width := p.peek()
+		if isDelimiter(r) {
+			break
+		}
+		p.pos += width
+	}
+	return p.s[start:p.pos]
+}
+
+// value parses out a (possibly quoted) value.
+func (p *commandParser) value() (string, error) {
+	val, ok, err := p.token()
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", p.errorf("expected value")
+	}
+	return val, nil
+}
+
+// token parses out a (possibly quoted) name, key or value, returning false if
+// there's none.
+func (p *commandParser) token() (string, bool, error) {
+	if p.done() || p.s[p.pos] != '"' {
+		word := p.word()
+		return word, word != "", nil
+	}
+
+	quoted, err := strconv.QuotedPrefix(p.s[p.pos:])
+	if err != nil {
+		return "", false, p.errorf("malformed quoted string")
+	}
+	p.pos += len(quoted)
+	unquoted, err := strconv.Unquote(quoted)
+	if err != nil {
+		return "", false, err
+	}
+	return unquoted, true, nil
+}
+
+func (p *commandParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("col %d: %s", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+// Matcher reports whether a command provided to Next matches one found in the
+// recording, when replaying.
+type Matcher func(recorded, actual string) bool
+
+// WithMatcher is used to configure a Recorder to match commands using the
+// given Matcher, instead of requiring them to be identical. This applies to
+// all modes of matching (see WithMatching), and to lookups in earlier
+// recordings (see WithPreserve and WithRecordMissing).
+func WithMatcher(m Matcher) Option {
+	return func(r *Recorder) {
+		r.matcher = m
+	}
+}
+
+// MatchOption configures the Matcher returned by MatchCommands.
+type MatchOption func(*commandMatcher)
+
+// IgnoreArgOrder configures MatchCommands to disregard the order arguments are
+// specified in.
+func IgnoreArgOrder() MatchOption {
+	return func(m *commandMatcher) {
+		m.ignoreOrder = true
+	}
+}
+
+// IgnoreArgs configures MatchCommands to disregard arguments with the given
+// keys.
+func IgnoreArgs(keys ...string) MatchOption {
+	return func(m *commandMatcher) {
+		for _, key := range keys {
+			m.ignored[key] = struct{}{}
+		}
+	}
+}
+
+// MatchCommands returns a Matcher that parses commands into their structured
+// form (see Command) and compares them as such, as configured by the given
+// options. Commands that don't parse are required to be identical.
+func MatchCommands(opts ...MatchOption) Matcher {
+	m := &commandMatcher{ignored: make(map[string]struct{})}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m.match
+}
+
+type commandMatcher struct {
+	ignoreOrder bool
+	ignored     map[string]struct{}
+}
+
+func (m *commandMatcher) match(recorded, actual string) bool {
+	if recorded == actual {
+		return true
+	}
+
+	a, err := ParseCommand(recorded)
+	if err != nil {
+		return false
+	}
+	b, err := ParseCommand(actual)
+	if err != nil {
+		return false
+	}
+	if a.Name != b.Name {
+		return false
+	}
+
+	argsA, argsB := m.filter(a.Args), m.filter(b.Args)
+	if len(argsA) != len(argsB) {
+		return false
+	}
+	for i := range argsA {
+		if argsA[i].String() != argsB[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+// filter drops ignored arguments, sorting the remaining ones if the argument
+// order is to be disregarded.
+func (m *commandMatcher) filter(args []Arg) []Arg {
+	var filtered []Arg
+	for _, arg := range args {
+		if _, ok := m.ignored[arg.Key]; !ok {
+			filtered = append(filtered, arg)
+		}
+	}
+	if m.ignoreOrder {
+		sort.SliceStable(filtered, func(i, j int) bool {
+			return filtered[i].Key < filtered[j].Key
+		})
+	}
+	return filtered
+}
@@ -0,0 +1,158 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package recorder
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommand(t *testing.T) {
+	for _, tc := range []struct {
+		cmd     Command
+		printed string
+	}{
+		{Cmd("ls"), "ls"},
+		{Cmd("ls", KV("all")), "ls all"},
+		{Cmd("exec", KV("argv", "git", "status"), KV("dir", "/src")), "exec argv=(git,status) dir=/src"},
+		{Cmd("cat", KV("path", "a b")), `cat path="a b"`},
+		{Cmd("cat", KV("path", "")), `cat path=""`},
+		{Cmd("echo", KV("args", "a,b", "(c)", "d=e", `"f"`, "g\nh")), `echo args=("a,b","(c)","d=e","\"f\"","g\nh")`},
+		{Cmd("echo", KV("args", "ü")), `echo args=ü`},
+		{Cmd("stat", KV("path", `/tmp/dir\`)), `stat path="/tmp/dir\\"`},
+		{Cmd("a b", KV("c,d", "e"), KV("")), `"a b" "c,d"=e ""`},
+		{Cmd("#x", KV("#y")), `"#x" #y`},
+	} {
+		require.Equal(t, tc.printed, tc.cmd.String())
+
+		parsed, err := ParseCommand(tc.printed)
+		require.NoError(t, err)
+		require.Equal(t, tc.cmd.String(), parsed.String())
+		require.Equal(t, tc.cmd.Name, parsed.Name)
+		require.Equal(t, len(tc.cmd.Args), len(parsed.Args))
+	}
+
+	parsed, err := ParseCommand("exec  argv=( git , status )  verbose ")
+	require.NoError(t, err)
+	require.Equal(t, Cmd("exec", KV("argv", "git", "status"), KV("verbose")), parsed)
+
+	arg, ok := parsed.Arg("argv")
+	require.True(t, ok)
+	require.Equal(t, []string{"git", "status"}, arg.Vals)
+	require.Equal(t, "git", parsed.Val("argv"))
+	require.Equal(t, "", parsed.Val("verbose"))
+	require.Equal(t, "", parsed.Val("missing"))
+
+	for _, tc := range []struct {
+		input, err string
+	}{
+		{"", "col 1: expected command name"},
+		{"cmd =a", `col 5: expected argument key, found '='`},
+		{"cmd a=", "col 7: expected value"},
+		{"cmd a=(b c)", `col 10: expected ',' or ')' in list of values for "a"`},
+		{`cmd a="b`, "col 7: malformed quoted string"},
+	} {
+		_, err := ParseCommand(tc.input)
+		require.EqualError(t, err, tc.err, tc.input)
+	}
+}
+
+func TestWrappedCommands(t *testing.T) {
+	short := Cmd("stat", KV("path", `/tmp/dir\`)).String()
+	long := Cmd("exec", KV("argv", "sh", "-c", strings.Repeat("x", 60)), KV("dir", `C:\src\`), KV("verbose")).String()
+
+	buffer := bytes.NewBuffer(nil)
+	recorder := New(WithRecording(buffer))
+	for _, command := range []string{short, long} {
+		_, err := recorder.Next(command, func() (string, error) {
+			return "ok\n", nil
+		})
+		require.NoError(t, err)
+	}
+
+	expected := `
+stat path="/tmp/dir\\"
+----
+ok
+
+exec argv=(sh,-c,` + strings.Repeat("x", 60) + `) \
+  dir="C:\\src\\" \
+  verbose
+----
+ok
+
+`
+	require.Equal(t, strings.TrimLeft(expected, "\n"), buffer.String())
+
+	replayer := New(WithReplay(buffer, "recording"))
+	for _, command := range []string{short, long} {
+		output, err := replayer.Next(command, nil)
+		require.NoError(t, err)
+		require.Equal(t, "ok\n", output)
+	}
+	require.NoError(t, replayer.Close())
+}
+
+func TestMatchCommands(t *testing.T) {
+	for _, tc := range []struct {
+		matcher          Matcher
+		recorded, actual string
+		expected         bool
+	}{
+		{MatchCommands(), "exec a=1 b=2", "exec a=1 b=2", true},
+		{MatchCommands(), "exec a=1 b=2", "exec  a=1   b=2", true},
+		{MatchCommands(), "exec a=1 b=2", "exec b=2 a=1", false},
+		{MatchCommands(IgnoreArgOrder()), "exec a=1 b=2", "exec b=2 a=1", true},
+		{MatchCommands(IgnoreArgOrder()), "exec a=1 b=2", "exec b=2 a=3", false},
+		{MatchCommands(IgnoreArgs("seed")), "exec a=1 seed=42", "exec a=1 seed=7", true},
+		{MatchCommands(IgnoreArgs("seed")), "exec a=1 seed=42", "exec a=1", true},
+		{MatchCommands(IgnoreArgs("seed")), "exec a=1 seed=42", "run a=1 seed=42", false},
+		{MatchCommands(), `exec a=(`, `exec a=(`, true},
+		{MatchCommands(), `exec a=(`, `exec  a=(`, false},
+	} {
+		require.Equal(t, tc.expected, tc.matcher(tc.recorded, tc.actual), "%s vs. %s", tc.recorded, tc.actual)
+	}
+}
+
+func TestRecorderMatcher(t *testing.T) {
+	data := `
+exec argv=(date) seed=1
+----
+Fri Mar 12
+
+exec argv=(ls) dir=/src seed=2
+----
+a
+`
+
+	for _, matching := range []Matching{Ordered, Unordered} {
+		reader := New(
+			WithReplay(strings.NewReader(data), "recording"),
+			WithMatching(matching),
+			WithMatcher(MatchCommands(IgnoreArgOrder(), IgnoreArgs("seed"))),
+		)
+		output, err := reader.Next("exec seed=3 argv=(date)", nil)
+		require.NoError(t, err)
+		require.Equal(t, "Fri Mar 12\n", output)
+
+		output, err = reader.Next("exec dir=/src argv=(ls) seed=4", nil)
+		require.NoError(t, err)
+		require.Equal(t, "a\n", output)
+		require.NoError(t, reader.Close())
+	}
+}
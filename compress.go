@@ -0,0 +1,125 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package recorder
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	// gzipMagic and zstdMagic are the magic bytes compressed recordings start
+	// with.
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// WithGzip is used to configure a Recorder (set to record) to gzip-compress the
+// recording. The grammar within is unchanged. Recordings are decompressed
+// transparently when replaying, detected as such by their leading magic bytes,
+// so there's no corresponding option for WithReplay.
+//
+// The compressed stream is only completely written out once the Recorder is
+// closed (see Close).
+func WithGzip() Option {
+	return func(r *Recorder) {
+		r.compressor = func(w io.Writer) io.WriteCloser {
+			return gzip.NewWriter(w)
+		}
+	}
+}
+
+// WithZstd is used to configure a Recorder (set to record) to zstd-compress the
+// recording. Like with WithGzip, recordings are decompressed transparently
+// when replaying, and the compressed stream is only completely written out
+// once the Recorder is closed.
+func WithZstd() Option {
+	return func(r *Recorder) {
+		r.compressor = func(w io.Writer) io.WriteCloser {
+			encoder, _ := zstd.NewWriter(w) // errors only for invalid options
+			return encoder
+		}
+	}
+}
+
+// compressWriter compresses what's written to the underlying io.Writer.
+type compressWriter struct {
+	io.WriteCloser // the compressed stream
+	underlying     io.Writer
+}
+
+// Close flushes the compressed stream, and closes the underlying io.Writer if
+// it's an io.Closer.
+func (w *compressWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	if closer, ok := w.underlying.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// decompressor transparently decompresses the recording read from the
+// underlying io.Reader, if compressed. What the recording is compressed with
+// (if at all) is determined on the first read.
+type decompressor struct {
+	underlying io.Reader
+	reader     io.Reader
+}
+
+// Read implements the io.Reader interface.
+func (d *decompressor) Read(p []byte) (int, error) {
+	if d.reader == nil {
+		reader, _, err := Decompress(d.underlying)
+		if err != nil {
+			return 0, err
+		}
+		d.reader = reader
+	}
+	return d.reader.Read(p)
+}
+
+// Decompress returns a reader for the decompressed form of the recording read
+// from the given io.Reader, detecting what it's compressed with (if at all)
+// the same way Recorders do when replaying. It also returns the name of the
+// compression detected, "gzip" or "zstd", or the empty string if the
+// recording is not compressed.
+func Decompress(from io.Reader) (r io.Reader, compression string, err error) {
+	buffered := bufio.NewReader(from)
+	magic, _ := buffered.Peek(len(zstdMagic)) // errors surface on subsequent reads
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		reader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, "", err
+		}
+		return reader, "gzip", nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		// Decoding synchronously doesn't leave behind goroutines that'd need
+		// to be cleaned up.
+		reader, err := zstd.NewReader(buffered, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, "", err
+		}
+		return reader, "zstd", nil
+	default:
+		return buffered, "", nil
+	}
+}
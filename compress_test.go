@@ -0,0 +1,107 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package recorder
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecorderCompression(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		option Option
+		magic  []byte
+	}{
+		{"gzip", WithGzip(), gzipMagic},
+		{"zstd", WithZstd(), zstdMagic},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			buffer := &closeBuffer{}
+			recorder := New(WithRecording(buffer), tc.option)
+			for _, command := range []string{"command-a", "command-b"} {
+				_, err := recorder.Next(command, func() (string, error) {
+					return "output\n", nil
+				})
+				require.NoError(t, err)
+			}
+			require.NoError(t, recorder.Close())
+			require.True(t, buffer.closed)
+			require.True(t, bytes.HasPrefix(buffer.Bytes(), tc.magic))
+
+			// The grammar is unchanged within.
+			reader, compression, err := Decompress(bytes.NewReader(buffer.Bytes()))
+			require.NoError(t, err)
+			require.Equal(t, tc.name, compression)
+			decompressed, err := ioutil.ReadAll(reader)
+			require.NoError(t, err)
+			require.Equal(t, "command-a\n----\noutput\n\ncommand-b\n----\noutput\n\n", string(decompressed))
+
+			// Compressed recordings are detected as such when replaying.
+			replayer := New(WithReplay(bytes.NewReader(buffer.Bytes()), "recording"))
+			for _, command := range []string{"command-a", "command-b"} {
+				output, err := replayer.Next(command, nil)
+				require.NoError(t, err)
+				require.Equal(t, "output\n", output)
+			}
+			require.NoError(t, replayer.Close())
+
+			// Corrupted recordings are reported as such.
+			corrupted := append([]byte(nil), buffer.Bytes()[:len(buffer.Bytes())/2]...)
+			replayer = New(WithReplay(bytes.NewReader(corrupted), "recording"))
+			_, err = replayer.Next("command-a", nil)
+			var parseErr *ParseError
+			require.True(t, errors.As(err, &parseErr))
+			require.Contains(t, parseErr.Msg, "unable to read recording")
+		})
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	const recording = "command\n----\noutput\n"
+
+	var gzipped, zstded bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipped)
+	_, err := gzipWriter.Write([]byte(recording))
+	require.NoError(t, err)
+	require.NoError(t, gzipWriter.Close())
+	zstdWriter, err := zstd.NewWriter(&zstded)
+	require.NoError(t, err)
+	_, err = zstdWriter.Write([]byte(recording))
+	require.NoError(t, err)
+	require.NoError(t, zstdWriter.Close())
+
+	for _, tc := range []struct {
+		data        []byte
+		compression string
+	}{
+		{[]byte(recording), ""},
+		{gzipped.Bytes(), "gzip"},
+		{zstded.Bytes(), "zstd"},
+	} {
+		reader, compression, err := Decompress(bytes.NewReader(tc.data))
+		require.NoError(t, err)
+		require.Equal(t, tc.compression, compression)
+		decompressed, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, recording, string(decompressed))
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package recorder
+
+// Do is a typed variant of Next. It executes the given callback, recording or
+// replaying its result depending on how the Recorder is configured (see Next).
+// The encoder is used to convert results to the string form Recorders
+// understand, and is only invoked when recording. The decoder is used to
+// convert them back, and is only invoked when playing back. When the Recorder
+// is nil (i.e. Live), the callback's result is returned as is, without paying
+// for a round trip through its string form.
+//
+//      func (g *globber) glob(pattern string) ([]string, error) {
+//          return recorder.Do(g.Recorder, pattern, func() ([]string, error) {
+//              return filepath.Glob(pattern) // do the real thing
+//          }, encode, decode)
+//      }
+func Do[T any](
+	r *Recorder,
+	command string,
+	f func() (T, error),
+	encode func(T) (string, error),
+	decode func(string) (T, error),
+) (T, error) {
+	if r.Mode() == Live {
+		return f()
+	}
+	if r.reporter != nil {
+		r.reporter.Helper()
+	}
+
+	var result T
+	var encoded string
+	var invoked bool
+	var encodeErr error
+	output, err := r.Next(command, func() (string, error) {
+		v, err := f()
+		if err != nil {
+			return "", err
+		}
+		s, err := encode(v)
+		if err != nil {
+			// Failing to encode the result is no fault of the callback's, so
+			// it's not to be recorded as its error.
+			encodeErr = err
+			return "", errUnrecorded
+		}
+		result, encoded, invoked = v, s, true
+		return s, nil
+	})
+	if encodeErr != nil {
+		var zero T
+		return zero, encodeErr
+	}
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+
+	if invoked && output == encoded {
+		// We recorded the callback's result, so we can return it as is. When
+		// recording operations missing from an earlier recording, or when
+		// preserving pinned ones, the output could come from the recording
+		// instead; we decode it below.
+		return result, nil
+	}
+	return decode(output)
+}
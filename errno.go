@@ -0,0 +1,46 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+//go:build !plan9
+
+package recorder
+
+import (
+	"sync"
+	"syscall"
+)
+
+// maxErrno bounds the error numbers we consider when mapping messages back to
+// a syscall.Errno.
+const maxErrno = 4096
+
+var errnos struct {
+	once  sync.Once
+	byMsg map[string]syscall.Errno
+}
+
+// lookupErrno returns the syscall.Errno with the given message, if any.
+func lookupErrno(msg string) (error, bool) {
+	errnos.once.Do(func() {
+		errnos.byMsg = make(map[string]syscall.Errno)
+		for i := maxErrno - 1; i > 0; i-- {
+			// Iterate in reverse so that for errors that share a message
+			// (EAGAIN and EWOULDBLOCK, say), the lowest numbered one wins.
+			errno := syscall.Errno(i)
+			errnos.byMsg[errno.Error()] = errno
+		}
+	})
+	errno, ok := errnos.byMsg[msg]
+	return errno, ok
+}
@@ -0,0 +1,83 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package recorder
+
+import (
+	"errors"
+	"fmt"
+)
+
+// hint is appended to errors that are typically addressed by re-recording.
+const hint = "do you need to regenerate the recording using -record?"
+
+// ErrRecordingExhausted is returned (wrapped) by Next when replaying, if the
+// recording has no more operations left to play back.
+var ErrRecordingExhausted = errors.New("recording exhausted")
+
+// errUnrecorded is returned by callbacks provided to Next whose result is not
+// to be recorded (see Do). Next returns it as is, without recording anything.
+var errUnrecorded = errors.New("unrecorded")
+
+// MismatchError is returned by Next when replaying, if the command found in the
+// recording differs from the one provided.
+type MismatchError struct {
+	Name     string // name of the recording, as provided to WithReplay
+	Line     int    // line number of the recorded command
+	Expected string // command found in the recording
+	Actual   string // command provided to Next
+}
+
+// Error implements the error interface.
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("%s:%d: expected: %q\ngot: %q\n\n%s",
+		e.Name, e.Line, e.Expected, e.Actual, hint)
+}
+
+// ParseError is returned when a recording is malformed, i.e. it does not
+// conform to the grammar (see the comment on Recorder).
+type ParseError struct {
+	Name   string // name of the recording, as provided to WithReplay
+	Line   int    // line number the error was found on
+	Column int    // column number the error was found at, zero if unknown
+	Msg    string // description of the error
+}
+
+// Error implements the error interface.
+func (e *ParseError) Error() string {
+	if e.Column > 0 {
+		return fmt.Sprintf("%s:%d:%d: %s", e.Name, e.Line, e.Column, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.Name, e.Line, e.Msg)
+}
+
+// RecordedError is returned by Next when replaying an operation that had
+// errored out when recorded. It carries the original error's message, and if
+// registered using WithErrors, wraps the original sentinel error.
+type RecordedError struct {
+	Msg string // message of the recorded error
+
+	sentinel error
+}
+
+// Error implements the error interface.
+func (e *RecordedError) Error() string {
+	return e.Msg
+}
+
+// Unwrap returns the registered sentinel error the recorded error corresponds
+// to, if any.
+func (e *RecordedError) Unwrap() error {
+	return e.sentinel
+}
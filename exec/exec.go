@@ -0,0 +1,500 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package exec runs external commands, recording and replaying them through a
+// recorder.Recorder. It mirrors the parts of os/exec that don't involve
+// interacting with running processes.
+//
+// Commands are recorded in the structured form (see recorder.Command), with
+// their arguments, working directory, selected environment variables and
+// input. Their outputs and exit codes are recorded as separate sections:
+//
+//   exec argv=(sh,-c,"echo hello; echo oops >&2; exit 3") dir=/src
+//   ----
+//   stdout:
+//     hello
+//   stderr:
+//     oops
+//   exit: 3
+//
+// Commands that exit with a non-zero exit code result in an *ExitError, both
+// when recording and replaying.
+package exec
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	osexec "os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/irfansharif/recorder"
+)
+
+// Cmd is an external command being prepared or run, mirroring exec.Cmd. It's
+// recorded or replayed through the Recorder it was constructed with; if nil,
+// the command is simply run.
+//
+// Stdin is read in full before the command is run, and its outputs are written
+// to Stdout and Stderr once it exits.
+type Cmd struct {
+	// Args holds the command line arguments, including the command itself as
+	// Args[0].
+	Args []string
+
+	// Env specifies the environment of the command, as in exec.Cmd. If nil,
+	// the command uses the current process's environment.
+	Env []string
+
+	// RecordEnv holds the names of environment variables (found in Env, or
+	// the current process's environment if nil) that are recorded as part of
+	// the command. Commands that differ only in other environment variables
+	// are considered identical.
+	RecordEnv []string
+
+	// Dir specifies the working directory of the command, as in exec.Cmd.
+	Dir string
+
+	// Stdin, Stdout and Stderr specify the command's input and outputs, as in
+	// exec.Cmd.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	ctx      context.Context
+	recorder *recorder.Recorder
+
+	started bool
+	// live is the underlying command when simply run, i.e. not recorded or
+	// replayed.
+	live *osexec.Cmd
+	// command is the recorded form of the command. input is what was read
+	// from Stdin.
+	command string
+	input   []byte
+	// done is closed once the command has been recorded or replayed, with
+	// output and err set to the result.
+	done   chan struct{}
+	output string
+	err    error
+}
+
+// Command returns a Cmd to execute the named program with the given arguments,
+// recorded or replayed through the given Recorder. Unlike exec.Command, the
+// program is not looked up until it's run, and only when it's not being
+// replayed.
+func Command(r *recorder.Recorder, name string, arg ...string) *Cmd {
+	return CommandContext(context.Background(), r, name, arg...)
+}
+
+// CommandContext is like Command, but includes a context. The context is used
+// to kill the process (when not replaying) if it becomes done before the
+// command completes on its own.
+func CommandContext(ctx context.Context, r *recorder.Recorder, name string, arg ...string) *Cmd {
+	return &Cmd{
+		Args:     append([]string{name}, arg...),
+		ctx:      ctx,
+		recorder: r,
+	}
+}
+
+// String returns the recorded form of the command.
+func (c *Cmd) String() string {
+	cmd := recorder.Cmd("exec", recorder.KV("argv", c.Args...))
+	if c.Dir != "" {
+		cmd.Args = append(cmd.Args, recorder.KV("dir", c.Dir))
+	}
+	if env := c.recordedEnv(); len(env) > 0 {
+		cmd.Args = append(cmd.Args, recorder.KV("env", env...))
+	}
+	if c.input != nil {
+		cmd.Args = append(cmd.Args, recorder.KV("stdin", string(c.input)))
+	}
+	return cmd.String()
+}
+
+// recordedEnv returns the environment variables that are recorded as part of
+// the command (see RecordEnv).
+func (c *Cmd) recordedEnv() []string {
+	env := c.Env
+	if env == nil {
+		env = os.Environ()
+	}
+
+	var recorded []string
+	for _, key := range c.RecordEnv {
+		// Later entries take precedence, as in exec.Cmd.
+		for i := len(env) - 1; i >= 0; i-- {
+			if strings.HasPrefix(env[i], key+"=") {
+				recorded = append(recorded, env[i])
+				break
+			}
+		}
+	}
+	return recorded
+}
+
+// Run starts the command and waits for it to complete, as in exec.Cmd.
+func (c *Cmd) Run() error {
+	if err := c.Start(); err != nil {
+		return err
+	}
+	return c.Wait()
+}
+
+// Output runs the command and returns its standard output, as in exec.Cmd.
+func (c *Cmd) Output() ([]byte, error) {
+	if c.Stdout != nil {
+		return nil, errors.New("exec: Stdout already set")
+	}
+	var stdout, stderr bytes.Buffer
+	c.Stdout = &stdout
+	captureErr := c.Stderr == nil
+	if captureErr {
+		c.Stderr = &stderr
+	}
+
+	err := c.Run()
+	var exitErr *ExitError
+	if err != nil && captureErr && errors.As(err, &exitErr) {
+		exitErr.Stderr = stderr.Bytes()
+	}
+	return stdout.Bytes(), err
+}
+
+// CombinedOutput runs the command and returns its combined standard output and
+// standard error, as in exec.Cmd.
+func (c *Cmd) CombinedOutput() ([]byte, error) {
+	if c.Stdout != nil {
+		return nil, errors.New("exec: Stdout already set")
+	}
+	if c.Stderr != nil {
+		return nil, errors.New("exec: Stderr already set")
+	}
+	var combined bytes.Buffer
+	c.Stdout = &combined
+	c.Stderr = &combined
+	err := c.Run()
+	return combined.Bytes(), err
+}
+
+// Start starts the command but does not wait for it to complete, as in
+// exec.Cmd. When replaying, the command is replayed right away, though its
+// outcome (including failing to start) is only returned once waited for (see
+// Wait).
+//
+// Commands are recorded in the order they're started in, regardless of the
+// order they complete (or are waited for) in, so that overlapping commands are
+// replayed in the same order (see recorder.Recorder.Reserve).
+func (c *Cmd) Start() error {
+	if c.started {
+		return errors.New("exec: already started")
+	}
+	c.started = true
+
+	if c.recorder == nil {
+		// Do the real thing; we're not recording or replaying.
+		c.live = c.newCmd()
+		c.live.Stdin, c.live.Stdout, c.live.Stderr = c.Stdin, c.Stdout, c.Stderr
+		return c.live.Start()
+	}
+
+	if c.Stdin != nil {
+		input, err := ioutil.ReadAll(c.Stdin)
+		if err != nil {
+			return err
+		}
+		c.input = input
+	}
+	c.command = c.String()
+	c.done = make(chan struct{})
+
+	next := c.recorder.Reserve()
+	if c.recorder.Mode() == recorder.Replaying {
+		c.next(next, nil)
+		return nil
+	}
+
+	// The command is recorded once it completes, so we run it in the
+	// background, waiting only for it to start.
+	started := make(chan error, 1)
+	go c.next(next, started)
+	select {
+	case err := <-started:
+		if err != nil {
+			// Wait for the failure to be recorded.
+			<-c.done
+		}
+		return err
+	case <-c.done:
+		select {
+		case err := <-started:
+			return err
+		default:
+			// The command was played back from an earlier recording, without
+			// being run (see recorder.WithRecordMissing).
+			return nil
+		}
+	}
+}
+
+// next records or replays the command using the given variant of
+// recorder.Recorder.Next, signaling on the given channel once it's started, if
+// run (it's nil when replaying).
+func (c *Cmd) next(next func(string, func() (string, error)) (string, error), started chan<- error) {
+	defer close(c.done)
+	c.output, c.err = next(c.command, func() (string, error) {
+		cmd := c.newCmd()
+		if c.input != nil {
+			cmd.Stdin = bytes.NewReader(c.input)
+		}
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		combined := interfaceEqual(c.Stdout, c.Stderr) && c.Stdout != nil
+		if combined {
+			cmd.Stderr = &stdout
+		}
+
+		err := cmd.Start()
+		started <- err
+		if err != nil {
+			return "", err
+		}
+
+		res := result{combined: combined}
+		if err := cmd.Wait(); err != nil {
+			var exitErr *osexec.ExitError
+			if !errors.As(err, &exitErr) {
+				return "", err
+			}
+			res.code, res.status = exitErr.ExitCode(), exitErr.String()
+		}
+		res.stdout, res.stderr = stdout.String(), stderr.String()
+		return res.encode(), nil
+	})
+}
+
+// newCmd returns the underlying command to run.
+func (c *Cmd) newCmd() *osexec.Cmd {
+	cmd := osexec.CommandContext(c.ctx, c.Args[0], c.Args[1:]...)
+	cmd.Env, cmd.Dir = c.Env, c.Dir
+	return cmd
+}
+
+// Wait waits for the command to complete, as in exec.Cmd. Outputs are then
+// written out to Stdout and Stderr. If the command exited with a non-zero exit
+// code, the error is an *ExitError.
+func (c *Cmd) Wait() error {
+	if !c.started {
+		return errors.New("exec: not started")
+	}
+	if c.live != nil {
+		err := c.live.Wait()
+		var exitErr *osexec.ExitError
+		if errors.As(err, &exitErr) {
+			return &ExitError{Code: exitErr.ExitCode(), Status: exitErr.String(), Stderr: exitErr.Stderr}
+		}
+		return err
+	}
+	if c.done == nil {
+		return errors.New("exec: Wait was already called")
+	}
+
+	<-c.done
+	c.done = nil
+	if c.err != nil {
+		return c.err
+	}
+
+	var res result
+	if err := res.decode(c.output); err != nil {
+		return fmt.Errorf("exec: unable to decode recorded output for %q: %v", c.command, err)
+	}
+	if res.combined {
+		res.stdout, res.stderr = res.stdout+res.stderr, ""
+	}
+	if c.Stdout != nil {
+		if _, err := io.WriteString(c.Stdout, res.stdout); err != nil {
+			return err
+		}
+	}
+	if c.Stderr != nil && res.stderr != "" {
+		if _, err := io.WriteString(c.Stderr, res.stderr); err != nil {
+			return err
+		}
+	}
+	if res.code != 0 {
+		return &ExitError{Code: res.code, Status: res.status}
+	}
+	return nil
+}
+
+// ExitError reports an unsuccessful exit by a command, mirroring
+// exec.ExitError.
+type ExitError struct {
+	// Code is the exit code of the command, or -1 if it was terminated by a
+	// signal.
+	Code int
+	// Status describes how the command exited, e.g. "exit status 1" or
+	// "signal: killed".
+	Status string
+	// Stderr holds the standard error output of the command, if it was not
+	// otherwise collected (see Output).
+	Stderr []byte
+}
+
+// Error implements the error interface.
+func (e *ExitError) Error() string {
+	return e.Status
+}
+
+// ExitCode returns the exit code of the command, or -1 if it was terminated by
+// a signal.
+func (e *ExitError) ExitCode() int {
+	return e.Code
+}
+
+// result is the outcome of a command, as recorded.
+type result struct {
+	stdout, stderr string
+	// combined is set if stdout and stderr were collected together, in which
+	// case they're recorded as the "output" section.
+	combined bool
+	code     int
+	status   string
+}
+
+// encode returns the recorded form of the result. Sections with empty contents
+// are omitted, and contents are indented.
+//
+//   stdout:
+//     <stdout>
+//   stderr (noeol):
+//     <stderr, not newline terminated>
+//   exit: 1
+//   status: signal: killed
+func (r result) encode() string {
+	var sb strings.Builder
+	if r.combined {
+		writeSection(&sb, "output", r.stdout)
+	} else {
+		writeSection(&sb, "stdout", r.stdout)
+		writeSection(&sb, "stderr", r.stderr)
+	}
+	fmt.Fprintf(&sb, "exit: %d\n", r.code)
+	if r.status != "" && r.status != defaultStatus(r.code) {
+		fmt.Fprintf(&sb, "status: %s\n", r.status)
+	}
+	return sb.String()
+}
+
+func writeSection(sb *strings.Builder, name, contents string) {
+	if contents == "" {
+		return
+	}
+	sb.WriteString(name)
+	if !strings.HasSuffix(contents, "\n") {
+		sb.WriteString(" (noeol)")
+		contents += "\n"
+	}
+	sb.WriteString(":\n")
+	for _, line := range strings.SplitAfter(contents, "\n") {
+		if line != "" {
+			sb.WriteString("  ")
+			sb.WriteString(line)
+		}
+	}
+}
+
+// defaultStatus returns the status of commands that exit with the given code.
+func defaultStatus(code int) string {
+	return fmt.Sprintf("exit status %d", code)
+}
+
+// decode parses out the result from its recorded form (see encode).
+func (r *result) decode(s string) error {
+	var section *string
+	var noeol bool
+	terminate := func() {
+		if section != nil && noeol {
+			*section = strings.TrimSuffix(*section, "\n")
+		}
+		section, noeol = nil, false
+	}
+
+	var sawExit bool
+	for _, line := range strings.SplitAfter(s, "\n") {
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "  ") && section != nil {
+			*section += strings.TrimPrefix(line, "  ")
+			continue
+		}
+		terminate()
+
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "exit: "):
+			code, err := strconv.Atoi(strings.TrimPrefix(line, "exit: "))
+			if err != nil {
+				return fmt.Errorf("malformed exit code %q", line)
+			}
+			r.code, sawExit = code, true
+		case strings.HasPrefix(line, "status: "):
+			r.status = strings.TrimPrefix(line, "status: ")
+		default:
+			name := strings.TrimSuffix(line, ":")
+			if name == line {
+				return fmt.Errorf("unexpected line %q", line)
+			}
+			if strings.HasSuffix(name, " (noeol)") {
+				name, noeol = strings.TrimSuffix(name, " (noeol)"), true
+			}
+			switch name {
+			case "stdout":
+				section = &r.stdout
+			case "stderr":
+				section = &r.stderr
+			case "output":
+				section, r.combined = &r.stdout, true
+			default:
+				return fmt.Errorf("unknown section %q", name)
+			}
+		}
+	}
+	terminate()
+
+	if !sawExit {
+		return errors.New("missing exit code")
+	}
+	if r.status == "" {
+		r.status = defaultStatus(r.code)
+	}
+	return nil
+}
+
+// interfaceEqual protects against panics from doing equality tests on two
+// interfaces with non-comparable underlying types (as in exec.Cmd).
+func interfaceEqual(a, b interface{}) bool {
+	defer func() {
+		recover()
+	}()
+	return a == b
+}
@@ -0,0 +1,185 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package exec
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/irfansharif/recorder"
+	"github.com/stretchr/testify/require"
+)
+
+// run exercises the given Recorder with a set of commands, checking that the
+// results are as expected.
+func run(t *testing.T, r *recorder.Recorder, dir string) {
+	output, err := Command(r, "sh", "-c", "echo hello; echo oops >&2; exit 3").Output()
+	require.Equal(t, "hello\n", string(output))
+	var exitErr *ExitError
+	require.True(t, errors.As(err, &exitErr))
+	require.Equal(t, 3, exitErr.ExitCode())
+	require.Equal(t, "exit status 3", exitErr.Error())
+	require.Equal(t, "oops\n", string(exitErr.Stderr))
+
+	output, err = Command(r, "sh", "-c", "echo a; echo b >&2; printf c").CombinedOutput()
+	require.NoError(t, err)
+	require.Equal(t, "a\nb\nc", string(output))
+
+	var stdout bytes.Buffer
+	cmd := Command(r, "sh", "-c", `cat; echo "$GREETING from $(basename "$PWD")"; touch created`)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GREETING=hi", "UNRECORDED=value")
+	cmd.RecordEnv = []string{"GREETING"}
+	cmd.Stdin = strings.NewReader("input\n")
+	cmd.Stdout = &stdout
+	require.NoError(t, cmd.Start())
+	require.NoError(t, cmd.Wait())
+	require.Equal(t, "input\nhi from dir\n", stdout.String())
+
+	err = Command(r, "nonexistent-binary").Run()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "executable file not found")
+}
+
+func TestCmd(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "dir")
+	require.NoError(t, os.Mkdir(dir, 0755))
+
+	// Record the real thing.
+	var buffer bytes.Buffer
+	r := recorder.New(recorder.WithRecording(&buffer), recorder.WithNormalizer(recorder.NormalizeDir(dir, "DIR")))
+	run(t, r, dir)
+	require.FileExists(t, filepath.Join(dir, "created"))
+
+	expected := `
+exec argv=(sh,-c,"echo hello; echo oops >&2; exit 3")
+----
+stdout:
+  hello
+stderr:
+  oops
+exit: 3
+
+exec argv=(sh,-c,"echo a; echo b >&2; printf c")
+----
+output (noeol):
+  a
+  b
+  c
+exit: 0
+
+exec argv=(sh,-c,"cat; echo \"$GREETING from $(basename \"$PWD\")\"; touch created") \
+  dir=${DIR} \
+  env="GREETING=hi" \
+  stdin="input\n"
+----
+stdout:
+  input
+  hi from dir
+exit: 0
+
+exec argv=nonexistent-binary
+---- error
+exec: "nonexistent-binary": executable file not found in $PATH
+
+`
+	require.Equal(t, strings.TrimLeft(expected, "\n"), buffer.String())
+
+	// Play it back, without running anything.
+	require.NoError(t, os.Remove(filepath.Join(dir, "created")))
+	r = recorder.New(recorder.WithReplay(&buffer, "recording"), recorder.WithNormalizer(recorder.NormalizeDir(dir, "DIR")))
+	run(t, r, dir)
+	require.NoFileExists(t, filepath.Join(dir, "created"))
+	require.NoError(t, r.Close())
+
+	// Simply run it, without a Recorder.
+	run(t, nil, dir)
+	require.FileExists(t, filepath.Join(dir, "created"))
+}
+
+func TestCmdOverlapping(t *testing.T) {
+	// overlap starts a slow command and a quick one, waiting for them in the
+	// order they were started in, and then runs another.
+	overlap := func(r *recorder.Recorder) {
+		var slow, quick bytes.Buffer
+		a := Command(r, "sh", "-c", "sleep 0.2; echo slow")
+		a.Stdout = &slow
+		b := Command(r, "echo", "quick")
+		b.Stdout = &quick
+		require.NoError(t, a.Start())
+		require.NoError(t, b.Start())
+		require.NoError(t, a.Wait())
+		require.NoError(t, b.Wait())
+		require.Equal(t, "slow\n", slow.String())
+		require.Equal(t, "quick\n", quick.String())
+
+		output, err := Command(r, "echo", "after").Output()
+		require.NoError(t, err)
+		require.Equal(t, "after\n", string(output))
+	}
+
+	// Commands are recorded in the order they're started in, not the order
+	// they complete in.
+	var buffer bytes.Buffer
+	r := recorder.New(recorder.WithRecording(&buffer))
+	overlap(r)
+	require.NoError(t, r.Close())
+
+	expected := `
+exec argv=(sh,-c,"sleep 0.2; echo slow")
+----
+stdout:
+  slow
+exit: 0
+
+exec argv=(echo,quick)
+----
+stdout:
+  quick
+exit: 0
+
+exec argv=(echo,after)
+----
+stdout:
+  after
+exit: 0
+
+`
+	require.Equal(t, strings.TrimLeft(expected, "\n"), buffer.String())
+
+	// Play it back, in the default ordered fashion.
+	r = recorder.New(recorder.WithReplay(&buffer, "recording"))
+	overlap(r)
+	require.NoError(t, r.Close())
+}
+
+func TestResult(t *testing.T) {
+	for _, res := range []result{
+		{},
+		{stdout: "out\n", stderr: "err", code: 1, status: "exit status 1"},
+		{stdout: "  indented\n\n  \n", combined: true, code: -1, status: "signal: killed"},
+	} {
+		var decoded result
+		require.NoError(t, decoded.decode(res.encode()))
+		if res.status == "" {
+			res.status = defaultStatus(res.code)
+		}
+		require.Equal(t, res, decoded)
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package recorder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// Format is the serialized form of recordings. TextFormat, the human-readable
+// grammar described in the comment on Recorder, is the default; JSONLFormat is
+// intended for consumption by other tools. Recordings can be converted between
+// formats without loss (see Convert).
+type Format interface {
+	// encode returns the serialized form of the given operation.
+	encode(op operation) ([]byte, error)
+	// encodeTrailing returns the serialized form of the given comments, found
+	// at the end of the recording (see Recorder.trailing).
+	encodeTrailing(comments []string) ([]byte, error)
+	// decode parses out the next operation from the recorder's scanner into
+	// its scratch space, returning whether one was found.
+	decode(r *Recorder) (parsed bool, err error)
+	// resync skips past the remainder of a malformed operation in the
+	// recorder's scanner, allowing decoding to resume from the next one.
+	resync(r *Recorder)
+}
+
+// WithFormat is used to configure the Format a Recorder records in or replays
+// from. The Format applies to earlier recordings too (see WithPreserve and
+// WithRecordMissing).
+func WithFormat(f Format) Option {
+	return func(r *Recorder) {
+		r.format = f
+	}
+}
+
+// TextFormat returns the human-readable Format described in the comment on
+// Recorder. It's the default.
+func TextFormat() Format {
+	return textFormat{}
+}
+
+type textFormat struct{}
+
+var _ Format = textFormat{}
+
+// encode implements the Format interface.
+func (textFormat) encode(op operation) ([]byte, error) {
+	if !isTextCommand(op.command) {
+		return nil, fmt.Errorf("command %q cannot be represented in the text format", op.command)
+	}
+	for _, comment := range op.comments {
+		if !isTextComment(comment) {
+			return nil, fmt.Errorf("comment %q cannot be represented in the text format", comment)
+		}
+	}
+	if err := checkTextDetached(op.detached); err != nil {
+		return nil, err
+	}
+	return []byte(op.String()), nil
+}
+
+// encodeTrailing implements the Format interface.
+func (textFormat) encodeTrailing(comments []string) ([]byte, error) {
+	if err := checkTextDetached(comments); err != nil {
+		return nil, err
+	}
+	return []byte(detachedString(comments)), nil
+}
+
+// isTextComment returns whether the given comment survives a round trip
+// through the text format.
+func isTextComment(comment string) bool {
+	return strings.HasPrefix(comment, "#") && comment == strings.TrimSpace(comment) && !strings.ContainsAny(comment, "\r\n")
+}
+
+// checkTextDetached checks that the given detached comments survive a round
+// trip through the text format: comments separated by single blank lines.
+func checkTextDetached(detached []string) error {
+	for i, comment := range detached {
+		if comment == "" && i > 0 && i < len(detached)-1 && detached[i-1] != "" {
+			continue
+		}
+		if !isTextComment(comment) {
+			return fmt.Errorf("comment %q cannot be represented in the text format", comment)
+		}
+	}
+	return nil
+}
+
+// decode implements the Format interface.
+func (textFormat) decode(r *Recorder) (bool, error) {
+	return r.parseOperation()
+}
+
+// resync implements the Format interface. It skips past the rest of the
+// malformed operation, up until the blank line that terminates it.
+func (textFormat) resync(r *Recorder) {
+	for r.scanner.Scan() {
+		if strings.TrimSpace(r.scanner.Text()) == "" {
+			return
+		}
+	}
+}
+
+// isTextCommand returns whether the given command survives a round trip
+// through the text format, i.e. it's a single line that doesn't get mistaken
+// for a comment, or for one that wraps onto the next line.
+func isTextCommand(command string) bool {
+	return command != "" &&
+		command == strings.TrimSpace(command) &&
+		!strings.ContainsAny(command, "\r\n") &&
+		!strings.HasPrefix(command, "#") &&
+		!strings.HasSuffix(command, `\`)
+}
+
+// JSONLFormat returns a Format where each operation is recorded as a JSON
+// object on a line of its own (JSON Lines), with the following fields:
+//
+//   {"command": ..., "output": ..., "error": true, "comments": [...]}
+//
+// Output that's not valid UTF-8 is recorded base64 encoded, as
+// "output_base64", and outputs stored separately (see WithBlobs) are
+// referenced by "blob". Comments not attached to the operation are recorded
+// as "detached"; ones at the end of the recording are recorded as an object
+// of their own, with no "command". Fields with empty values are omitted.
+// Blank lines are ignored.
+func JSONLFormat() Format {
+	return jsonlFormat{}
+}
+
+type jsonlFormat struct{}
+
+var _ Format = jsonlFormat{}
+
+// jsonlOperation is the JSON form of an operation.
+type jsonlOperation struct {
+	Command      string   `json:"command,omitempty"`
+	Output       string   `json:"output,omitempty"`
+	OutputBase64 []byte   `json:"output_base64,omitempty"`
+	Error        bool     `json:"error,omitempty"`
+	Comments     []string `json:"comments,omitempty"`
+	Detached     []string `json:"detached,omitempty"`
+	Blob         string   `json:"blob,omitempty"`
+}
+
+// encode implements the Format interface.
+func (jsonlFormat) encode(op operation) ([]byte, error) {
+	if !utf8.ValidString(op.command) {
+		return nil, fmt.Errorf("command %q cannot be represented in the JSONL format: invalid UTF-8", op.command)
+	}
+
+	jop := jsonlOperation{
+		Command:  op.command,
+		Output:   op.output,
+		Error:    op.isError,
+		Comments: op.comments,
+		Detached: op.detached,
+		Blob:     op.blob,
+	}
+	if !utf8.ValidString(op.output) {
+		jop.Output, jop.OutputBase64 = "", []byte(op.output)
+	}
+	return encodeJSONL(jop)
+}
+
+// encodeTrailing implements the Format interface.
+func (jsonlFormat) encodeTrailing(comments []string) ([]byte, error) {
+	return encodeJSONL(jsonlOperation{Detached: comments})
+}
+
+// encodeJSONL returns the JSON form of the given operation, on a line of its
+// own.
+func encodeJSONL(jop jsonlOperation) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(jop); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil // newline terminated
+}
+
+// decode implements the Format interface.
+func (jsonlFormat) decode(r *Recorder) (bool, error) {
+	var trailing []string
+	for r.scanner.Scan() {
+		line := r.scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		var jop jsonlOperation
+		decoder := json.NewDecoder(strings.NewReader(line))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&jop); err != nil {
+			return false, r.scanner.errorf("unable to parse operation: %v", err)
+		}
+		if decoder.More() {
+			return false, r.scanner.errorf("unable to parse operation: trailing data after JSON object")
+		}
+		if jop.isTrailing() {
+			// Comments found at the end of the recording.
+			trailing = append(trailing, jop.Detached...)
+			continue
+		}
+		if jop.Command == "" {
+			return false, r.scanner.errorf("unable to parse operation: missing command")
+		}
+		if trailing != nil {
+			return false, r.scanner.errorf("unable to parse operation: found after trailing comments")
+		}
+		if jop.OutputBase64 != nil && (jop.Output != "" || jop.Blob != "") {
+			return false, r.scanner.errorf("unable to parse operation: \"output_base64\" is not valid alongside other outputs")
+		}
+		if jop.Blob != "" && (jop.Output != "" || !isBlobRef(jop.Blob)) {
+			return false, r.scanner.errorf("unable to parse operation: malformed blob reference %q", jop.Blob)
+		}
+
+		r.op = operation{
+			command:  jop.Command,
+			output:   jop.Output,
+			isError:  jop.Error,
+			comments: jop.Comments,
+			detached: jop.Detached,
+			blob:     jop.Blob,
+			line:     r.scanner.line,
+		}
+		if jop.OutputBase64 != nil {
+			r.op.output = string(jop.OutputBase64)
+		}
+		for _, comment := range jop.Comments {
+			if comment == keepDirective {
+				r.op.keep = true
+			}
+		}
+		return true, nil
+	}
+	if trailing != nil {
+		r.trailing = trailing
+	}
+	return false, nil
+}
+
+// isTrailing returns whether the object holds the comments found at the end
+// of the recording, as opposed to an operation.
+func (jop jsonlOperation) isTrailing() bool {
+	return jop.Command == "" && len(jop.Detached) > 0 && jop.Output == "" && jop.OutputBase64 == nil &&
+		!jop.Error && jop.Comments == nil && jop.Blob == ""
+}
+
+// resync implements the Format interface. Operations span a single line, so
+// there's nothing to skip.
+func (jsonlFormat) resync(r *Recorder) {}
+
+// Convert reads the recording from the given io.Reader in one Format, and
+// writes it out to the given io.Writer in another. Everything recorded,
+// including comments, is retained. The provided name is used only for
+// diagnostic purposes.
+func Convert(from io.Reader, name string, fromFormat Format, to io.Writer, toFormat Format) error {
+	// Read the recording in full before writing anything out, so as to not
+	// write out partial recordings if malformed.
+	var ops []Operation
+	decoder := NewDecoder(from, name, fromFormat)
+	for {
+		op, err := decoder.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		ops = append(ops, op)
+	}
+
+	encoder := NewEncoder(to, toFormat)
+	for _, op := range ops {
+		if err := encoder.Encode(op); err != nil {
+			return err
+		}
+	}
+	return encoder.EncodeTrailing(decoder.Trailing())
+}
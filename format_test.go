@@ -0,0 +1,122 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package recorder
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONLFormat(t *testing.T) {
+	buffer := bytes.NewBuffer(nil)
+	recorder := New(WithRecording(buffer), WithFormat(JSONLFormat()))
+	for _, tc := range []struct {
+		command, output string
+		err             error
+	}{
+		{"command-a", "a <b>\n", nil},
+		{"command-b", "\xff\x00", nil},
+		{"command-c", "", errors.New("c")},
+	} {
+		_, err := recorder.Next(tc.command, func() (string, error) {
+			return tc.output, tc.err
+		})
+		require.Equal(t, tc.err, err)
+	}
+
+	expected := `
+{"command":"command-a","output":"a <b>\n"}
+{"command":"command-b","output_base64":"/wA="}
+{"command":"command-c","output":"c\n","error":true}
+`
+	require.Equal(t, strings.TrimLeft(expected, "\n"), buffer.String())
+
+	replayer := New(WithReplay(buffer, "recording.jsonl"), WithFormat(JSONLFormat()))
+	output, err := replayer.Next("command-a", nil)
+	require.NoError(t, err)
+	require.Equal(t, "a <b>\n", output)
+	output, err = replayer.Next("command-b", nil)
+	require.NoError(t, err)
+	require.Equal(t, "\xff\x00", output)
+	_, err = replayer.Next("command-c", nil)
+	require.EqualError(t, err, "c")
+	require.NoError(t, replayer.Close())
+
+	replayer = New(WithReplay(strings.NewReader(`{"command":"a","outptu":"b"}`), "recording.jsonl"), WithFormat(JSONLFormat()))
+	_, err = replayer.Next("a", nil)
+	var parseErr *ParseError
+	require.True(t, errors.As(err, &parseErr))
+	require.Contains(t, parseErr.Msg, `unknown field "outptu"`)
+}
+
+func TestConvert(t *testing.T) {
+	text := `
+# header
+
+# more of the header
+
+# keep
+command-a
+----
+output
+
+# detached
+
+command-b
+---- <<EOF noeol
+----
+EOF
+
+command-c
+---- error base64
+/wo=
+
+command-d
+---- blob sha256:5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03
+
+# trailing
+`
+	text = strings.TrimLeft(text, "\n")
+
+	var jsonl bytes.Buffer
+	require.NoError(t, Convert(strings.NewReader(text), "recording", TextFormat(), &jsonl, JSONLFormat()))
+	expected := `
+{"command":"command-a","output":"output\n","comments":["# keep"],"detached":["# header","","# more of the header"]}
+{"command":"command-b","output":"----","detached":["# detached"]}
+{"command":"command-c","output_base64":"/wo=","error":true}
+{"command":"command-d","blob":"sha256:5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"}
+{"detached":["# trailing"]}
+`
+	require.Equal(t, strings.TrimLeft(expected, "\n"), jsonl.String())
+
+	var roundtripped bytes.Buffer
+	require.NoError(t, Convert(&jsonl, "recording.jsonl", JSONLFormat(), &roundtripped, TextFormat()))
+	require.Equal(t, text, roundtripped.String())
+
+	// Not everything can be represented in the text format.
+	for _, data := range []string{
+		`{"command":"multi\nline"}`,
+		`{"command":"command","detached":["# a","",""]}`,
+		`{"detached":["not a comment"]}`,
+	} {
+		jsonl.Reset()
+		jsonl.WriteString(data)
+		require.Error(t, Convert(&jsonl, "recording.jsonl", JSONLFormat(), &roundtripped, TextFormat()), data)
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package recorder
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+// FS returns an fs.FS that records or replays the Open, Stat, ReadDir,
+// ReadFile and Glob calls made against it, depending on how the Recorder is
+// configured (see Next). When recording (or if the Recorder is nil), calls are
+// served by the given base filesystem. When replaying, they're served entirely
+// from the recording; base is never used, and can be nil.
+//
+// Calls are recorded in the structured form (see Command), with file info and
+// directory listings recorded as with the FileInfo and DirEntries codecs:
+//
+//      stat path=go.mod
+//      ----
+//      file name=go.mod size=34 mode=-rw-r--r-- modtime=2021-03-12T11:51:30Z
+//
+// Opening a file records its info followed by its contents (or for
+// directories, their entries), all of which is read upfront. Reads, seeks and
+// directory listings against the opened file are then served from memory.
+// Errors are recorded in their structured form too (see Errors), and are
+// replayed as *fs.PathErrors that match the same fs.ErrNotExist (etc.) errors
+// as the original.
+func FS(r *Recorder, base fs.FS) fs.FS {
+	return &recordedFS{r: r, base: base}
+}
+
+type recordedFS struct {
+	r    *Recorder
+	base fs.FS
+}
+
+var (
+	_ fs.StatFS     = &recordedFS{}
+	_ fs.ReadDirFS  = &recordedFS{}
+	_ fs.ReadFileFS = &recordedFS{}
+	_ fs.GlobFS     = &recordedFS{}
+)
+
+// Open implements the fs.FS interface.
+func (f *recordedFS) Open(name string) (fs.File, error) {
+	if f.r.Mode() == Live {
+		return f.base.Open(name)
+	}
+
+	contents, err := DoFS(f.r, Cmd("open", KV("path", name)), func() (fileContents, error) {
+		return readFileContents(f.base, name)
+	}, encodeFileContents, decodeFileContents)
+	if err != nil {
+		return nil, err
+	}
+	return &file{name: name, fileContents: contents, reader: bytes.NewReader(contents.data)}, nil
+}
+
+// Stat implements the fs.StatFS interface.
+func (f *recordedFS) Stat(name string) (fs.FileInfo, error) {
+	return DoFS(f.r, Cmd("stat", KV("path", name)), func() (fs.FileInfo, error) {
+		return fs.Stat(f.base, name)
+	}, FileInfo().Encode, FileInfo().Decode)
+}
+
+// ReadDir implements the fs.ReadDirFS interface.
+func (f *recordedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return DoFS(f.r, Cmd("read-dir", KV("path", name)), func() ([]fs.DirEntry, error) {
+		return fs.ReadDir(f.base, name)
+	}, DirEntries().Encode, DirEntries().Decode)
+}
+
+// ReadFile implements the fs.ReadFileFS interface.
+func (f *recordedFS) ReadFile(name string) ([]byte, error) {
+	return DoFS(f.r, Cmd("read-file", KV("path", name)), func() ([]byte, error) {
+		return fs.ReadFile(f.base, name)
+	}, func(data []byte) (string, error) {
+		return string(data), nil
+	}, func(s string) ([]byte, error) {
+		return []byte(s), nil
+	})
+}
+
+// Glob implements the fs.GlobFS interface.
+func (f *recordedFS) Glob(pattern string) ([]string, error) {
+	return DoFS(f.r, Cmd("glob", KV("pattern", pattern)), func() ([]string, error) {
+		return fs.Glob(f.base, pattern)
+	}, Strings().Encode, Strings().Decode)
+}
+
+// DoFS is a variant of Do for filesystem operations, recorded using the given
+// command in its structured form. Errors returned by the callback are recorded
+// in their structured form too (see Errors), and are decoded back when
+// replaying, as opposed to being replayed as *RecordedErrors. It's what FS and
+// package osfs are built on.
+func DoFS[T any](
+	r *Recorder,
+	cmd Command,
+	f func() (T, error),
+	encode func(T) (string, error),
+	decode func(string) (T, error),
+) (T, error) {
+	if r.Mode() == Live {
+		return f()
+	}
+	if r.reporter != nil {
+		r.reporter.Helper()
+	}
+
+	v, err := Do(r, cmd.String(), func() (T, error) {
+		v, err := f()
+		if err != nil {
+			return v, &fsError{err: err, cmd: cmd}
+		}
+		return v, nil
+	}, encode, decode)
+
+	var fsErr *fsError
+	var recorded *RecordedError
+	switch {
+	case errors.As(err, &fsErr):
+		return v, fsErr.err
+	case errors.As(err, &recorded):
+		return v, decodeError(recorded.Msg, cmd)
+	default:
+		return v, err
+	}
+}
+
+// fileContents is what's recorded when opening a file: its info, and its
+// contents or entries, for regular files and directories respectively.
+type fileContents struct {
+	info    fs.FileInfo
+	data    []byte
+	entries []fs.DirEntry
+}
+
+// readFileContents opens and reads the named file in its entirety.
+func readFileContents(fsys fs.FS, name string) (fileContents, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return fileContents{}, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var contents fileContents
+	if contents.info, err = f.Stat(); err != nil {
+		return fileContents{}, err
+	}
+	if !contents.info.IsDir() {
+		if contents.data, err = io.ReadAll(f); err != nil {
+			return fileContents{}, err
+		}
+		return contents, nil
+	}
+
+	dir, ok := f.(fs.ReadDirFile)
+	if !ok {
+		return fileContents{}, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not implemented")}
+	}
+	if contents.entries, err = dir.ReadDir(-1); err != nil {
+		return fileContents{}, err
+	}
+	return contents, nil
+}
+
+// encodeFileContents records the file's info on the first line, followed by
+// its contents or entries.
+func encodeFileContents(contents fileContents) (string, error) {
+	info, err := FileInfo().Encode(contents.info)
+	if err != nil {
+		return "", err
+	}
+	if contents.info.IsDir() {
+		entries, err := DirEntries().Encode(contents.entries)
+		if err != nil {
+			return "", err
+		}
+		return info + entries, nil
+	}
+	return info + string(contents.data), nil
+}
+
+// decodeFileContents is the inverse of encodeFileContents.
+func decodeFileContents(s string) (fileContents, error) {
+	line, rest := s, ""
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		line, rest = s[:i+1], s[i+1:]
+	}
+
+	var contents fileContents
+	var err error
+	if contents.info, err = FileInfo().Decode(line); err != nil {
+		return fileContents{}, err
+	}
+	if contents.info.IsDir() {
+		if contents.entries, err = DirEntries().Decode(rest); err != nil {
+			return fileContents{}, err
+		}
+		return contents, nil
+	}
+	contents.data = []byte(rest)
+	return contents, nil
+}
+
+// file is an opened file, served from memory.
+type file struct {
+	name string
+	fileContents
+	reader *bytes.Reader
+	read   int // number of directory entries read
+}
+
+var (
+	_ fs.ReadDirFile = &file{}
+	_ io.Seeker      = &file{}
+	_ io.ReaderAt    = &file{}
+)
+
+// Stat implements the fs.File interface.
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// Read implements the fs.File interface.
+func (f *file) Read(p []byte) (int, error) {
+	if f.info.IsDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrInvalid}
+	}
+	return f.reader.Read(p)
+}
+
+// Seek implements the io.Seeker interface.
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	if f.info.IsDir() {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	return f.reader.Seek(offset, whence)
+}
+
+// ReadAt implements the io.ReaderAt interface.
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	if f.info.IsDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrInvalid}
+	}
+	return f.reader.ReadAt(p, off)
+}
+
+// ReadDir implements the fs.ReadDirFile interface.
+func (f *file) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.info.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: fs.ErrInvalid}
+	}
+
+	entries := f.entries[f.read:]
+	if n > 0 && len(entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && n < len(entries) {
+		entries = entries[:n]
+	}
+	f.read += len(entries)
+	return entries, nil
+}
+
+// Close implements the fs.File interface.
+func (f *file) Close() error {
+	return nil
+}
+
+// fsError wraps errors returned when recording, so that they're recorded in
+// their structured form (see Errors).
+type fsError struct {
+	err error
+	cmd Command
+}
+
+// Error implements the error interface.
+func (e *fsError) Error() string {
+	return encodeError(e.err, e.cmd).String()
+}
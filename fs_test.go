@@ -0,0 +1,133 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package recorder
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFS(t *testing.T) {
+	modtime := time.Date(2021, 3, 12, 11, 51, 30, 0, time.UTC)
+	base := fstest.MapFS{
+		"go.mod":         {Data: []byte("module github.com/irfansharif/recorder\n"), Mode: 0644, ModTime: modtime},
+		"a/b/noeol.txt":  {Data: []byte("no trailing newline"), Mode: 0600, ModTime: modtime},
+		"a/b/binary.dat": {Data: []byte{0x00, 0xff, 0x10}, Mode: 0644, ModTime: modtime},
+		"a/empty":        {ModTime: modtime},
+		"c":              {Mode: fs.ModeDir | 0700, ModTime: modtime},
+	}
+	expected := []string{"go.mod", "a/b/noeol.txt", "a/b/binary.dat", "a/empty", "c"}
+
+	// Record the real thing.
+	var buffer bytes.Buffer
+	r := New(WithRecording(&buffer))
+	require.NoError(t, fstest.TestFS(FS(r, base), expected...))
+
+	_, err := FS(r, base).Open("missing")
+	require.True(t, errors.Is(err, fs.ErrNotExist))
+
+	recording := buffer.String()
+	for _, op := range []string{`
+open path=go.mod
+----
+file name=go.mod size=39 mode=-rw-r--r-- modtime=2021-03-12T11:51:30Z
+module github.com/irfansharif/recorder
+`, `
+open path=a/b
+----
+file name=b size=0 mode=dr-xr-xr-x modtime=0001-01-01T00:00:00Z
+file name=binary.dat size=3 mode=-rw-r--r-- modtime=2021-03-12T11:51:30Z
+file name=noeol.txt size=19 mode=-rw------- modtime=2021-03-12T11:51:30Z
+`, `
+read-file path=a/b/noeol.txt
+---- <<EOF noeol
+no trailing newline
+EOF
+`, `
+glob pattern=a/*b*
+----
+a/b
+`, `
+open path=missing
+---- error
+path-error op=open err="file does not exist"
+`} {
+		require.Contains(t, recording, strings.TrimPrefix(op, "\n"))
+	}
+
+	// Play it back, serving everything from the recording.
+	r = New(WithReplay(&buffer, "recording"))
+	require.NoError(t, fstest.TestFS(FS(r, nil), expected...))
+
+	_, err = FS(r, nil).Open("missing")
+	require.True(t, errors.Is(err, fs.ErrNotExist))
+	require.NoError(t, r.Close())
+
+	// Simply run it, without a Recorder.
+	require.NoError(t, fstest.TestFS(FS(nil, base), expected...))
+}
+
+func TestFSErrors(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file"), []byte("contents\n"), 0644))
+	base := os.DirFS(dir)
+
+	run := func(fsys fs.FS) {
+		_, err := fsys.Open("missing")
+		require.True(t, errors.Is(err, fs.ErrNotExist))
+		require.EqualError(t, err, "open missing: no such file or directory")
+
+		_, err = fs.ReadDir(fsys, "file")
+		var pathErr *fs.PathError
+		require.True(t, errors.As(err, &pathErr))
+		require.Equal(t, "file", pathErr.Path)
+
+		_, err = fs.Glob(fsys, "[")
+		require.Equal(t, err, filepath.ErrBadPattern)
+	}
+
+	var buffer bytes.Buffer
+	r := New(WithRecording(&buffer))
+	run(FS(r, base))
+
+	expected := `
+open path=missing
+---- error
+path-error op=open err="no such file or directory" is="file does not exist"
+
+read-dir path=file
+---- error
+path-error op=open err="not a directory"
+
+glob pattern=[
+---- error
+error err="syntax error in pattern"
+
+`
+	require.Equal(t, strings.TrimLeft(expected, "\n"), buffer.String())
+
+	r = New(WithReplay(&buffer, "recording"))
+	run(FS(r, nil))
+	require.NoError(t, r.Close())
+}
@@ -23,13 +23,18 @@ import (
 )
 
 func Fuzz(data []byte) int {
+	// Any output, treated as opaque bytes, should round trip through the
+	// recorder exactly.
+	fuzzOutput(string(data))
+
 	reader := New(WithReplay(bytes.NewReader(data), "fuzz"))
 	parsedOnce := false
 	for {
 		// Parse out the next operation.
-		var output, command string
+		var output, command, blob string
+		var isError bool
 		found, err := reader.step(func(op operation) {
-			command, output = op.command, op.output
+			command, output, isError, blob = op.command, op.output, op.isError, op.blob
 		})
 		if err != nil {
 			if output != "" || command != "" || found {
@@ -51,7 +56,7 @@ func Fuzz(data []byte) int {
 		// Write out the next operation, just to see that it goes through.
 		buffer := bytes.NewBuffer(nil)
 		writer := New(WithRecording(buffer))
-		if err := writer.record(operation{command, output}); err != nil {
+		if err := writer.record(operation{command: command, output: output, isError: isError, blob: blob}, nil); err != nil {
 			panic(err)
 		}
 
@@ -65,9 +70,43 @@ func Fuzz(data []byte) int {
 			if op.output != output {
 				panic(fmt.Sprintf("mismatched output: expected %q, got %q", output, op.output))
 			}
+			if op.isError != isError {
+				panic(fmt.Sprintf("mismatched error annotation: expected %t, got %t", isError, op.isError))
+			}
+			if op.blob != blob {
+				panic(fmt.Sprintf("mismatched blob reference: expected %q, got %q", blob, op.blob))
+			}
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// fuzzOutput checks that the given output survives a round trip through the
+// recorder, byte-for-byte.
+func fuzzOutput(output string) {
+	for _, isError := range []bool{false, true} {
+		buffer := bytes.NewBuffer(nil)
+		writer := New(WithRecording(buffer))
+		if err := writer.record(operation{command: "command", output: output, isError: isError}, nil); err != nil {
+			panic(err)
+		}
+
+		reader := New(WithReplay(buffer, "fuzz"))
+		found, err := reader.step(func(op operation) {
+			if op.output != output {
+				panic(fmt.Sprintf("mismatched output: expected %q, got %q", output, op.output))
+			}
+			if op.isError != isError {
+				panic(fmt.Sprintf("mismatched error annotation: expected %t, got %t", isError, op.isError))
+			}
 		})
 		if err != nil {
 			panic(err)
 		}
+		if !found {
+			panic(fmt.Sprintf("output %q not found after round trip", output))
+		}
 	}
 }
@@ -0,0 +1,60 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package httprec
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// BodyMatcher determines how request bodies are matched when replaying. It
+// returns the canonical form of the given body, which is what's recorded as
+// part of the command (and so what's compared against). Bodies with an empty
+// canonical form are left out of the command altogether.
+type BodyMatcher func(body []byte) string
+
+// ExactBody returns a BodyMatcher that matches request bodies exactly.
+func ExactBody() BodyMatcher {
+	return func(body []byte) string {
+		return string(body)
+	}
+}
+
+// JSONBody returns a BodyMatcher that matches JSON request bodies if they're
+// equivalent, regardless of whitespace and the order of object keys. Bodies
+// that aren't valid JSON are matched exactly.
+func JSONBody() BodyMatcher {
+	return func(body []byte) string {
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		var v interface{}
+		if err := decoder.Decode(&v); err != nil || decoder.More() {
+			return string(body)
+		}
+		canonical, err := json.Marshal(v) // object keys are sorted
+		if err != nil {
+			return string(body)
+		}
+		return string(canonical)
+	}
+}
+
+// IgnoreBody returns a BodyMatcher that ignores request bodies altogether;
+// they're not recorded.
+func IgnoreBody() BodyMatcher {
+	return func([]byte) string {
+		return ""
+	}
+}
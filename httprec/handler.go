@@ -0,0 +1,251 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package httprec
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/irfansharif/recorder"
+)
+
+// Handler returns middleware that records the requests received by the given
+// handler, along with the responses it returns, in the same form as outbound
+// requests are recorded in (see Transport). The request URL is recorded as
+// received, typically just the path and query. Recordings captured this way
+// can later be used as golden tests for the handler (see Replay).
+//
+// Only Recorders configured to record are used; otherwise requests are simply
+// passed through. Handler accepts the same options as New, with the exception
+// of WithBase, which is ignored.
+func Handler(r *recorder.Recorder, h http.Handler, opts ...Option) http.Handler {
+	t := New(r, opts...)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r.Mode() != recorder.Recording {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		var body []byte
+		if req.Body != nil {
+			var err error
+			body, err = io.ReadAll(req.Body)
+			_ = req.Body.Close()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		capture := &responseCapture{w: w}
+		h.ServeHTTP(capture, req)
+
+		// The response has already been sent, so there's no one to return
+		// errors recording it to; we log them instead (see also
+		// recorder.WithFatalOnError).
+		if _, err := r.Next(t.command(req, body).String(), func() (string, error) {
+			return t.encodeResponse(capture.response())
+		}); err != nil {
+			log.Printf("httprec: unable to record %s %s: %v", req.Method, req.URL, err)
+		}
+	})
+}
+
+// DiffError is returned by Replay when the handler's response to a recorded
+// request differs from the recorded response.
+type DiffError struct {
+	Name     string // name of the recording
+	Line     int    // line number of the recorded request
+	Request  string // recorded request
+	Expected string // recorded response
+	Actual   string // handler's response
+}
+
+// Error implements the error interface.
+func (e *DiffError) Error() string {
+	return fmt.Sprintf("%s:%d: mismatched response for %s\nexpected:\n%sgot:\n%s",
+		e.Name, e.Line, e.Request, indent(e.Expected), indent(e.Actual))
+}
+
+// Replay re-issues the requests in the given recording (typically captured
+// using Handler) against the given handler, one at a time and in order. It
+// returns a *DiffError for each request the handler's response differs from
+// the recorded one in, or any errors found reading the recording. The
+// recording is read in the given recorder.Format (the text format if nil),
+// and the provided name is used only for diagnostic purposes.
+//
+// Requests are reconstructed from their recorded form, so request headers
+// that aren't recorded (see WithRequestHeaders) are not re-issued; nor are
+// request bodies that aren't (see IgnoreBody). Redacted request headers are
+// re-issued with the ${REDACTED} placeholder as their value, unless restored
+// using WithReplayRequest. Responses are compared in their recorded form, so
+// the same options the recording was captured with should be used here.
+func Replay(from io.Reader, name string, format recorder.Format, h http.Handler, opts ...Option) []error {
+	t := New(nil, opts...)
+	decoder := recorder.NewDecoder(from, name, format)
+	var errs []error
+	for {
+		op, err := decoder.Decode()
+		if err == io.EOF {
+			return errs
+		}
+		if err != nil {
+			return append(errs, err)
+		}
+
+		req, err := parseRequest(op.Command)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %v", op.Name, op.Line, err))
+			continue
+		}
+		if op.Error || op.Blob != "" {
+			errs = append(errs, fmt.Errorf("%s:%d: expected recorded response", op.Name, op.Line))
+			continue
+		}
+
+		if t.replayRequest != nil {
+			t.replayRequest(req)
+		}
+		capture := &responseCapture{}
+		h.ServeHTTP(capture, req)
+		actual, err := t.encodeResponse(capture.response())
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %v", op.Name, op.Line, err))
+			continue
+		}
+		if actual != op.Output {
+			errs = append(errs, &DiffError{
+				Name:     op.Name,
+				Line:     op.Line,
+				Request:  op.Command,
+				Expected: op.Output,
+				Actual:   actual,
+			})
+		}
+	}
+}
+
+// parseRequest is the inverse of (*Transport).command, reconstructing the
+// request from its recorded form.
+func parseRequest(command string) (*http.Request, error) {
+	cmd, err := recorder.ParseCommand(command)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse request: %v", err)
+	}
+	if cmd.Name != "http" {
+		return nil, fmt.Errorf("unable to parse request: expected http, found %q", cmd.Name)
+	}
+
+	req, err := http.NewRequest(cmd.Val("method"), cmd.Val("url"), strings.NewReader(cmd.Val("body")))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse request: %v", err)
+	}
+	req.RequestURI = cmd.Val("url")
+	if header, ok := cmd.Arg("header"); ok {
+		for _, line := range header.Vals {
+			key, val, ok := strings.Cut(line, ": ")
+			if !ok {
+				return nil, fmt.Errorf("unable to parse request: malformed header %q", line)
+			}
+			req.Header.Add(key, val)
+		}
+	}
+	return req, nil
+}
+
+// responseCapture is an http.ResponseWriter that captures the response
+// written to it, passing it through to the underlying http.ResponseWriter, if
+// any.
+type responseCapture struct {
+	w      http.ResponseWriter
+	header http.Header // used if there's no underlying http.ResponseWriter
+
+	code     int
+	snapshot http.Header // headers, as of when they were written
+	body     bytes.Buffer
+}
+
+var _ http.Flusher = &responseCapture{}
+
+// Header implements the http.ResponseWriter interface.
+func (c *responseCapture) Header() http.Header {
+	if c.w != nil {
+		return c.w.Header()
+	}
+	if c.header == nil {
+		c.header = make(http.Header)
+	}
+	return c.header
+}
+
+// WriteHeader implements the http.ResponseWriter interface.
+func (c *responseCapture) WriteHeader(code int) {
+	if c.code != 0 {
+		return // superfluous
+	}
+	c.code, c.snapshot = code, c.Header().Clone()
+	if c.w != nil {
+		c.w.WriteHeader(code)
+	}
+}
+
+// Write implements the http.ResponseWriter interface.
+func (c *responseCapture) Write(p []byte) (int, error) {
+	c.WriteHeader(http.StatusOK)
+	c.body.Write(p)
+	if c.w != nil {
+		return c.w.Write(p)
+	}
+	return len(p), nil
+}
+
+// Flush implements the http.Flusher interface, if the underlying
+// http.ResponseWriter does.
+func (c *responseCapture) Flush() {
+	c.WriteHeader(http.StatusOK)
+	if flusher, ok := c.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// response returns the captured response.
+func (c *responseCapture) response() response {
+	c.WriteHeader(http.StatusOK) // if nothing was written
+	return response{
+		status: strings.TrimSpace(fmt.Sprintf("%d %s", c.code, http.StatusText(c.code))),
+		code:   c.code,
+		header: c.snapshot,
+		body:   c.body.Bytes(),
+	}
+}
+
+// indent indents the given (multi-line) text, leaving blank lines as is. The
+// result is newline terminated.
+func indent(s string) string {
+	var sb strings.Builder
+	for _, line := range strings.Split(strings.TrimSuffix(s, "\n"), "\n") {
+		if line != "" {
+			sb.WriteString("  ")
+		}
+		sb.WriteString(line)
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,196 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package httprec
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/irfansharif/recorder"
+	"github.com/stretchr/testify/require"
+)
+
+// counter returns a handler that keeps a count, incremented by the amount
+// POST-ed to it. Requests need to carry the "secret" api key.
+func counter(step int) http.Handler {
+	var count int
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Header.Get("X-Api-Key") {
+		case "secret":
+		case "":
+			http.Error(w, "missing api key", http.StatusUnauthorized)
+			return
+		default:
+			http.Error(w, "invalid api key", http.StatusUnauthorized)
+			return
+		}
+		if req.Method == http.MethodPost {
+			data, _ := io.ReadAll(req.Body)
+			var delta int
+			if _, err := fmt.Sscanf(string(data), "%d", &delta); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			count += delta * step
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = fmt.Fprintf(w, "count=%d\n", count)
+	})
+}
+
+func TestHandler(t *testing.T) {
+	opts := []Option{WithRequestHeaders("X-Api-Key"), WithRedactedHeaders("X-Api-Key")}
+
+	// Record real traffic.
+	var buffer bytes.Buffer
+	r := recorder.New(recorder.WithRecording(&buffer))
+	srv := httptest.NewServer(Handler(r, counter(1), opts...))
+	defer srv.Close()
+
+	for _, req := range []struct {
+		method, body, key string
+	}{
+		{"GET", "", "secret"},
+		{"POST", "2", "secret"},
+		{"POST", "three", "secret"},
+		{"GET", "", ""},
+	} {
+		request, err := http.NewRequest(req.method, srv.URL+"/count", strings.NewReader(req.body))
+		require.NoError(t, err)
+		if req.key != "" {
+			request.Header.Set("X-Api-Key", req.key)
+		}
+		resp, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+	}
+
+	expected := `
+http method=GET url=/count header="X-Api-Key: ${REDACTED}"
+----
+----
+200 OK
+Content-Type: text/plain
+
+count=0
+----
+----
+
+http method=POST url=/count header="X-Api-Key: ${REDACTED}" body=2
+----
+----
+200 OK
+Content-Type: text/plain
+
+count=2
+----
+----
+
+http method=POST url=/count header="X-Api-Key: ${REDACTED}" body=three
+----
+----
+400 Bad Request
+Content-Type: text/plain; charset=utf-8
+X-Content-Type-Options: nosniff
+
+expected integer
+----
+----
+
+http method=GET url=/count
+----
+----
+401 Unauthorized
+Content-Type: text/plain; charset=utf-8
+X-Content-Type-Options: nosniff
+
+missing api key
+----
+----
+
+`
+	require.Equal(t, strings.TrimLeft(expected, "\n"), buffer.String())
+	recording := buffer.String()
+
+	// Replay it against the same handler, restoring the redacted api key, and
+	// then a different one.
+	restore := WithReplayRequest(func(req *http.Request) {
+		if req.Header.Get("X-Api-Key") == recorder.Placeholder("REDACTED") {
+			req.Header.Set("X-Api-Key", "secret")
+		}
+	})
+	require.Empty(t, Replay(strings.NewReader(recording), "recording", nil, counter(1), append(opts, restore)...))
+
+	errs := Replay(strings.NewReader(recording), "recording", nil, counter(1), opts...)
+	require.Len(t, errs, 3)
+	require.Contains(t, errs[0].Error(), "invalid api key")
+
+	errs = Replay(strings.NewReader(recording), "recording", nil, counter(2), append(opts, restore)...)
+	require.Len(t, errs, 1)
+	var diffErr *DiffError
+	require.True(t, errors.As(errs[0], &diffErr))
+	require.Equal(t, 11, diffErr.Line)
+	require.Equal(t, `recording:11: mismatched response for http method=POST url=/count header="X-Api-Key: ${REDACTED}" body=2
+expected:
+  200 OK
+  Content-Type: text/plain
+
+  count=2
+got:
+  200 OK
+  Content-Type: text/plain
+
+  count=4
+`, diffErr.Error())
+
+	errs = Replay(strings.NewReader("exec argv=ls\n----\n\n"), "recording", nil, counter(1))
+	require.Len(t, errs, 1)
+	require.EqualError(t, errs[0], `recording:1: unable to parse request: expected http, found "exec"`)
+}
+
+// failingWriter is an io.Writer that always fails.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestHandlerLogsErrors(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	r := recorder.New(recorder.WithRecording(failingWriter{}))
+	srv := httptest.NewServer(Handler(r, counter(1)))
+	defer srv.Close()
+
+	request, err := http.NewRequest("GET", srv.URL+"/count", nil)
+	require.NoError(t, err)
+	request.Header.Set("X-Api-Key", "secret")
+	resp, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, logs.String(), "httprec: unable to record GET /count: ")
+	require.Contains(t, logs.String(), "disk full")
+}
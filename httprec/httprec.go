@@ -0,0 +1,349 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package httprec records and replays HTTP traffic through a
+// recorder.Recorder.
+//
+// Outbound requests are recorded in the structured form (see
+// recorder.Command), including the method, URL, selected headers and body.
+// Responses are recorded much like they're sent over the wire: the status
+// line, followed by headers, a blank line, and the body.
+//
+//   http method=POST \
+//     url=https://api.example.com/v1/items \
+//     header="Content-Type: application/json" \
+//     body="{\"name\":\"a\"}"
+//   ----
+//   ----
+//   201 Created
+//   Content-Type: application/json
+//
+//   {"id":1,"name":"a"}
+//   ----
+//   ----
+//
+// Inbound requests, as received by an http.Handler, can be recorded in the
+// same form (see Handler), and later replayed against it (see Replay).
+package httprec
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/irfansharif/recorder"
+)
+
+// Transport is an http.RoundTripper that records or replays the requests made
+// through it, depending on how the Recorder is configured (see
+// recorder.Recorder.Next). When recording (or if the Recorder is nil),
+// requests are sent using the underlying http.RoundTripper. When replaying,
+// responses are served entirely from the recording; no requests are sent.
+//
+// Responses are read in their entirety before being returned, and are served
+// from memory.
+type Transport struct {
+	r    *recorder.Recorder
+	base http.RoundTripper
+
+	requestHeaders  []string // canonicalized
+	responseHeaders []string // canonicalized; nil if recording all headers
+	redactedHeaders map[string]bool
+	redactedParams  map[string]bool
+	body            BodyMatcher
+	replayRequest   func(*http.Request) // used by Replay, if set
+}
+
+var _ http.RoundTripper = &Transport{}
+
+// Option is used to configure a Transport.
+type Option func(*Transport)
+
+// New returns a Transport that records or replays through the given Recorder.
+// By default requests are sent using http.DefaultTransport, request headers
+// aren't recorded, all response headers are, and request bodies are matched
+// exactly.
+func New(r *recorder.Recorder, opts ...Option) *Transport {
+	t := &Transport{
+		r:               r,
+		base:            http.DefaultTransport,
+		redactedHeaders: make(map[string]bool),
+		redactedParams:  make(map[string]bool),
+		body:            ExactBody(),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// WithBase is used to configure the http.RoundTripper requests are sent using.
+func WithBase(base http.RoundTripper) Option {
+	return func(t *Transport) {
+		t.base = base
+	}
+}
+
+// WithRequestHeaders is used to configure the request headers that are
+// recorded (and so compared against when replaying), if present. Other request
+// headers are ignored.
+func WithRequestHeaders(names ...string) Option {
+	return func(t *Transport) {
+		t.requestHeaders = append(t.requestHeaders, canonicalize(names)...)
+	}
+}
+
+// WithResponseHeaders is used to configure the response headers that are
+// recorded, if present. Other response headers are dropped.
+func WithResponseHeaders(names ...string) Option {
+	return func(t *Transport) {
+		t.responseHeaders = append(t.responseHeaders, canonicalize(names)...)
+	}
+}
+
+// WithRedactedHeaders is used to configure the request and response headers
+// whose values are replaced with the ${REDACTED} placeholder (see
+// recorder.Placeholder) when recorded. Redacted request headers still need to
+// be allow-listed using WithRequestHeaders to be recorded at all.
+func WithRedactedHeaders(names ...string) Option {
+	return func(t *Transport) {
+		for _, name := range canonicalize(names) {
+			t.redactedHeaders[name] = true
+		}
+	}
+}
+
+// WithRedactedParams is used to configure the URL query parameters whose
+// values are replaced with the ${REDACTED} placeholder when recorded.
+func WithRedactedParams(names ...string) Option {
+	return func(t *Transport) {
+		for _, name := range names {
+			t.redactedParams[name] = true
+		}
+	}
+}
+
+// WithBodyMatcher is used to configure how request bodies are matched (see
+// BodyMatcher).
+func WithBodyMatcher(m BodyMatcher) Option {
+	return func(t *Transport) {
+		t.body = m
+	}
+}
+
+// WithReplayRequest is used to configure Replay to pass each request through
+// the given function before re-issuing it, say to restore request headers
+// redacted when recording (see WithRedactedHeaders), which are otherwise
+// re-issued with the ${REDACTED} placeholder as their value. It's ignored by
+// Transport and Handler.
+func WithReplayRequest(fn func(*http.Request)) Option {
+	return func(t *Transport) {
+		t.replayRequest = fn
+	}
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.r.Mode() == recorder.Live {
+		return t.base.RoundTrip(req)
+	}
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := recorder.Do(t.r, t.command(req, body).String(), func() (response, error) {
+		req := req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+		resp, err := t.base.RoundTrip(req)
+		if err != nil {
+			return response{}, err
+		}
+		defer func() { _ = resp.Body.Close() }()
+
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return response{}, err
+		}
+		status := resp.Status
+		if status == "" {
+			status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+		}
+		return response{status: status, code: resp.StatusCode, header: resp.Header, body: data}, nil
+	}, t.encodeResponse, decodeResponse)
+	if err != nil {
+		return nil, err
+	}
+	return res.http(req), nil
+}
+
+// command returns the command the given request is recorded as:
+//
+//   http method=GET url=https://example.com/ header=("Accept: text/plain") body=...
+func (t *Transport) command(req *http.Request, body []byte) recorder.Command {
+	cmd := recorder.Cmd("http",
+		recorder.KV("method", req.Method),
+		recorder.KV("url", t.redactURL(req.URL.String())),
+	)
+	if headers := t.headerLines(req.Header, t.requestHeaders); len(headers) > 0 {
+		cmd.Args = append(cmd.Args, recorder.KV("header", headers...))
+	}
+	if b := t.body(body); b != "" {
+		cmd.Args = append(cmd.Args, recorder.KV("body", b))
+	}
+	return cmd
+}
+
+// headerLines returns the "Name: value" lines for the given headers, sorted by
+// name, redacting them as needed. If names is nil, all headers are included.
+func (t *Transport) headerLines(header http.Header, names []string) []string {
+	if names == nil {
+		for name := range header {
+			names = append(names, name)
+		}
+	}
+	names = append([]string(nil), names...)
+	sort.Strings(names)
+
+	var lines []string
+	for i, name := range names {
+		if i > 0 && names[i-1] == name {
+			continue // duplicate
+		}
+		for _, val := range header.Values(name) {
+			if t.redactedHeaders[textproto.CanonicalMIMEHeaderKey(name)] {
+				val = recorder.Placeholder("REDACTED")
+			}
+			lines = append(lines, fmt.Sprintf("%s: %s", name, val))
+		}
+	}
+	return lines
+}
+
+// redactURL redacts the configured query parameters from the given URL,
+// leaving it otherwise intact.
+func (t *Transport) redactURL(url string) string {
+	i := strings.IndexByte(url, '?')
+	if i < 0 || len(t.redactedParams) == 0 {
+		return url
+	}
+
+	query, fragment := url[i+1:], ""
+	if j := strings.IndexByte(query, '#'); j >= 0 {
+		query, fragment = query[:j], query[j:]
+	}
+	params := strings.Split(query, "&")
+	for k, param := range params {
+		if key, _, ok := strings.Cut(param, "="); ok && t.redactedParams[key] {
+			params[k] = key + "=" + recorder.Placeholder("REDACTED")
+		}
+	}
+	return url[:i+1] + strings.Join(params, "&") + fragment
+}
+
+// response is the recorded form of an http.Response.
+type response struct {
+	status string
+	code   int
+	header http.Header
+	body   []byte
+}
+
+// http returns the http.Response for the given request.
+func (r response) http(req *http.Request) *http.Response {
+	header := r.header
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		Status:        r.status,
+		StatusCode:    r.code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(r.body)),
+		ContentLength: int64(len(r.body)),
+		Request:       req,
+	}
+}
+
+// encodeResponse returns the recorded form of the given response: the status
+// line, followed by headers, a blank line, and the body.
+func (t *Transport) encodeResponse(r response) (string, error) {
+	var sb strings.Builder
+	sb.WriteString(r.status)
+	sb.WriteString("\n")
+	for _, line := range t.headerLines(r.header, t.responseHeaders) {
+		sb.WriteString(line)
+		sb.WriteString("\n")
+	}
+	sb.WriteString("\n")
+	sb.Write(r.body)
+	return sb.String(), nil
+}
+
+// decodeResponse is the inverse of encodeResponse.
+func decodeResponse(s string) (response, error) {
+	head, body, ok := strings.Cut(s, "\n\n")
+	if !ok {
+		return response{}, fmt.Errorf("unable to decode response: missing blank line after headers")
+	}
+
+	var r response
+	reader := textproto.NewReader(bufio.NewReader(strings.NewReader(head + "\n\n")))
+	status, err := reader.ReadLine()
+	if err != nil {
+		return response{}, fmt.Errorf("unable to decode response: %v", err)
+	}
+	code, _, _ := strings.Cut(status, " ")
+	if r.code, err = strconv.Atoi(code); err != nil {
+		return response{}, fmt.Errorf("unable to decode response: invalid status %q", status)
+	}
+	r.status = status
+
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return response{}, fmt.Errorf("unable to decode response: %v", err)
+	}
+	if len(header) > 0 {
+		r.header = http.Header(header)
+	}
+	r.body = []byte(body)
+	return r, nil
+}
+
+// canonicalize returns the canonical forms of the given header names.
+func canonicalize(names []string) []string {
+	canonical := make([]string, 0, len(names))
+	for _, name := range names {
+		canonical = append(canonical, textproto.CanonicalMIMEHeaderKey(name))
+	}
+	return canonical
+}
@@ -0,0 +1,181 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package httprec
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/irfansharif/recorder"
+	"github.com/stretchr/testify/require"
+)
+
+// server returns a test server that greets, echoes JSON request bodies back
+// with an ID, and 404s otherwise.
+func server(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/greeting", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Set-Cookie", "session=secret")
+		_, _ = io.WriteString(w, "hello, "+req.URL.Query().Get("name")+"\n")
+	})
+	mux.HandleFunc("/items", func(w http.ResponseWriter, req *http.Request) {
+		var item map[string]interface{}
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&item))
+		item["id"] = 1
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		require.NoError(t, json.NewEncoder(w).Encode(item))
+	})
+	return httptest.NewServer(mux)
+}
+
+// run issues a set of requests using the given Transport, checking that the
+// responses are as expected.
+func run(t *testing.T, transport *Transport, url string, body string) {
+	client := &http.Client{Transport: transport}
+
+	req, err := http.NewRequest("GET", url+"/greeting?name=world&token=hunter2", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer hunter2")
+	req.Header.Set("Accept", "text/plain")
+	req.Header.Set("User-Agent", "unrecorded")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+	require.Equal(t, "hello, world\n", read(t, resp))
+
+	resp, err = client.Post(url+"/items", "application/json", strings.NewReader(body))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, "201 Created", resp.Status)
+	require.JSONEq(t, `{"id":1,"name":"a","tags":["x"]}`, read(t, resp))
+
+	resp, err = client.Get(url + "/missing")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.Equal(t, "404 page not found\n", read(t, resp))
+}
+
+func read(t *testing.T, resp *http.Response) string {
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	return string(data)
+}
+
+func TestTransport(t *testing.T) {
+	srv := server(t)
+	opts := []Option{
+		WithRequestHeaders("Authorization", "accept"),
+		WithResponseHeaders("Content-Type", "Set-Cookie"),
+		WithRedactedHeaders("Authorization", "Set-Cookie"),
+		WithRedactedParams("token"),
+		WithBodyMatcher(JSONBody()),
+	}
+
+	// Record the real thing.
+	var buffer bytes.Buffer
+	r := recorder.New(recorder.WithRecording(&buffer), recorder.WithNormalizer(recorder.NormalizeDir(srv.URL, "SERVER")))
+	run(t, New(r, opts...), srv.URL, `{"name": "a", "tags": ["x"]}`)
+
+	expected := `
+http method=GET \
+  url="${SERVER}/greeting?name=world&token=${REDACTED}" \
+  header=("Accept: text/plain","Authorization: ${REDACTED}")
+----
+----
+200 OK
+Content-Type: text/plain
+Set-Cookie: ${REDACTED}
+
+hello, world
+----
+----
+
+http method=POST url=${SERVER}/items body="{\"name\":\"a\",\"tags\":[\"x\"]}"
+----
+----
+201 Created
+Content-Type: application/json
+
+{"id":1,"name":"a","tags":["x"]}
+----
+----
+
+http method=GET url=${SERVER}/missing
+----
+----
+404 Not Found
+Content-Type: text/plain; charset=utf-8
+
+404 page not found
+----
+----
+
+`
+	require.Equal(t, strings.TrimLeft(expected, "\n"), buffer.String())
+
+	// Play it back, without any server listening. The request body is
+	// equivalent, if not identical.
+	url := srv.URL
+	srv.Close()
+	r = recorder.New(recorder.WithReplay(&buffer, "recording"), recorder.WithNormalizer(recorder.NormalizeDir(url, "SERVER")))
+	run(t, New(r, opts...), url, `{"tags":["x"],"name":"a"}`)
+	require.NoError(t, r.Close())
+
+	// Simply run it, without a Recorder.
+	srv = server(t)
+	defer srv.Close()
+	run(t, New(nil, opts...), srv.URL, `{"name": "a", "tags": ["x"]}`)
+}
+
+func TestTransportErrors(t *testing.T) {
+	srv := server(t)
+	url := srv.URL
+	srv.Close()
+
+	var buffer bytes.Buffer
+	r := recorder.New(recorder.WithRecording(&buffer), recorder.WithNormalizer(recorder.NormalizeDir(url, "SERVER")))
+	_, err := (&http.Client{Transport: New(r)}).Get(url)
+	require.Error(t, err)
+	require.Contains(t, buffer.String(), "http method=GET url=${SERVER}\n---- error\n")
+
+	r = recorder.New(recorder.WithReplay(&buffer, "recording"), recorder.WithNormalizer(recorder.NormalizeDir(url, "SERVER")))
+	_, replayed := (&http.Client{Transport: New(r)}).Get(url)
+	require.Equal(t, err.Error(), replayed.Error())
+}
+
+func TestBodyMatchers(t *testing.T) {
+	for _, tc := range []struct {
+		matcher  BodyMatcher
+		body     string
+		expected string
+	}{
+		{ExactBody(), `{"b": 1, "a": 2}`, `{"b": 1, "a": 2}`},
+		{JSONBody(), `{"b": 1, "a": [2.50, "x"]}`, `{"a":[2.50,"x"],"b":1}`},
+		{JSONBody(), `not json`, `not json`},
+		{JSONBody(), `{} {}`, `{} {}`},
+		{IgnoreBody(), `{"b": 1}`, ``},
+	} {
+		require.Equal(t, tc.expected, tc.matcher([]byte(tc.body)), tc.body)
+	}
+}
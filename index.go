@@ -0,0 +1,75 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package recorder
+
+import "sort"
+
+// index is used to look up recorded operations by command, as opposed to
+// stepping through them in the order they were recorded in. Operations with
+// identical commands are maintained in per-command FIFO queues, retaining their
+// relative order.
+type index struct {
+	queues map[string][]operation
+}
+
+func newIndex(ops []operation) *index {
+	idx := &index{queues: make(map[string][]operation)}
+	for _, op := range ops {
+		idx.queues[op.command] = append(idx.queues[op.command], op)
+	}
+	return idx
+}
+
+// pop removes and returns the first operation with the given command, if any.
+// If a matcher is provided, it's the first operation (in the order they
+// appeared in the recording) whose command matches the given one.
+func (i *index) pop(command string, matcher Matcher) (op operation, ok bool) {
+	key := command
+	if matcher != nil {
+		var found bool
+		for recorded, queue := range i.queues {
+			if len(queue) == 0 || !matcher(recorded, command) {
+				continue
+			}
+			if !found || queue[0].line < i.queues[key][0].line {
+				key, found = recorded, true
+			}
+		}
+		if !found {
+			return operation{}, false
+		}
+	}
+
+	queue := i.queues[key]
+	if len(queue) == 0 {
+		return operation{}, false
+	}
+
+	op, i.queues[key] = queue[0], queue[1:]
+	return op, true
+}
+
+// remaining returns all operations that are yet to be popped, in the order they
+// appeared in the recording.
+func (i *index) remaining() []operation {
+	var ops []operation
+	for _, queue := range i.queues {
+		ops = append(ops, queue...)
+	}
+	sort.Slice(ops, func(a, b int) bool {
+		return ops[a].line < ops[b].line
+	})
+	return ops
+}
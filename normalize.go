@@ -0,0 +1,118 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package recorder
+
+import (
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Normalizer rewrites commands before they're recorded, or compared against
+// recorded ones when replaying. It's typically used to replace the
+// nondeterministic portions of a command (temporary directories, timestamps,
+// etc.) with placeholders (see Placeholder), keeping recordings portable
+// across runs and machines. Normalizers are expected to be idempotent.
+type Normalizer func(command string) string
+
+// WithNormalizer is used to configure a Recorder to normalize commands
+// provided to Next using the given Normalizer. Normalizers are applied in the
+// order they're configured in. Given commands in the recording are compared
+// against as is, recordings need to be regenerated after adding normalizers.
+func WithNormalizer(n Normalizer) Option {
+	return func(r *Recorder) {
+		r.normalizers = append(r.normalizers, n)
+	}
+}
+
+// Placeholder returns the placeholder with the given name, of the form
+// ${NAME}, as used by the built-in normalizers.
+func Placeholder(name string) string {
+	return "${" + name + "}"
+}
+
+// NormalizeDir returns a Normalizer that replaces the given directory with the
+// ${NAME} placeholder.
+func NormalizeDir(dir, name string) Normalizer {
+	return func(command string) string {
+		if dir == "" {
+			return command
+		}
+		return strings.ReplaceAll(command, dir, Placeholder(name))
+	}
+}
+
+// NormalizeTempDir returns a Normalizer that replaces the system's temporary
+// directory (see os.TempDir), along with the (typically randomly named)
+// directory created within it, with the ${TMPDIR} placeholder. For example,
+// both /tmp/TestFoo123/001/a and /tmp/build-456/a are normalized to
+// ${TMPDIR}/001/a and ${TMPDIR}/a respectively.
+func NormalizeTempDir() Normalizer {
+	dir := strings.TrimRight(os.TempDir(), `/\`)
+	re := regexp.MustCompile(regexp.QuoteMeta(dir) + `[/\\][^/\\\s]+`)
+	return normalizePattern(re, "TMPDIR")
+}
+
+// NormalizeHome returns a Normalizer that replaces the current user's home
+// directory (see os.UserHomeDir) with the ${HOME} placeholder.
+func NormalizeHome() Normalizer {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = ""
+	}
+	return NormalizeDir(home, "HOME")
+}
+
+// NormalizeTimestamps returns a Normalizer that replaces RFC 3339 timestamps
+// (2006-01-02T15:04:05Z07:00, optionally with fractional seconds) with the
+// ${TIMESTAMP} placeholder.
+func NormalizeTimestamps() Normalizer {
+	return normalizePattern(timestampRE, "TIMESTAMP")
+}
+
+// NormalizeUUIDs returns a Normalizer that replaces UUIDs with the ${UUID}
+// placeholder.
+func NormalizeUUIDs() Normalizer {
+	return normalizePattern(uuidRE, "UUID")
+}
+
+// NormalizeHexHashes returns a Normalizer that replaces hex-encoded hashes
+// (32, 40 or 64 hex digits long, as in MD5, SHA-1 and SHA-256 digests) with the
+// ${HASH} placeholder.
+func NormalizeHexHashes() Normalizer {
+	return normalizePattern(hashRE, "HASH")
+}
+
+var (
+	timestampRE = regexp.MustCompile(`\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2})`)
+	uuidRE      = regexp.MustCompile(`(?i)\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b`)
+	hashRE      = regexp.MustCompile(`(?i)\b([0-9a-f]{64}|[0-9a-f]{40}|[0-9a-f]{32})\b`)
+)
+
+// normalizePattern returns a Normalizer that replaces all matches of the given
+// regular expression with the ${NAME} placeholder.
+func normalizePattern(re *regexp.Regexp, name string) Normalizer {
+	return func(command string) string {
+		return re.ReplaceAllLiteralString(command, Placeholder(name))
+	}
+}
+
+// normalize applies the configured normalizers to the given command.
+func (r *Recorder) normalize(command string) string {
+	for _, n := range r.normalizers {
+		command = n(command)
+	}
+	return command
+}
@@ -0,0 +1,80 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package recorder
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizers(t *testing.T) {
+	for _, tc := range []struct {
+		normalizer        Normalizer
+		command, expected string
+	}{
+		{
+			normalizer: NormalizeDir("/home/irfansharif", "HOME"),
+			command:    "ls /home/irfansharif/src",
+			expected:   "ls ${HOME}/src",
+		},
+		{
+			normalizer: NormalizeTempDir(),
+			command:    "cat " + filepath.Join(os.TempDir(), "TestFoo123", "001", "a"),
+			expected:   "cat ${TMPDIR}" + string(filepath.Separator) + filepath.Join("001", "a"),
+		},
+		{
+			normalizer: NormalizeTimestamps(),
+			command:    "log --since=2021-03-12T11:51:30Z --until=2021-03-12T11:51:30.123-05:00",
+			expected:   "log --since=${TIMESTAMP} --until=${TIMESTAMP}",
+		},
+		{
+			normalizer: NormalizeUUIDs(),
+			command:    "get 123e4567-e89b-12d3-a456-426614174000",
+			expected:   "get ${UUID}",
+		},
+		{
+			normalizer: NormalizeHexHashes(),
+			command:    "git show 24c093c0a1b2c3d4e5f60718293a4b5c6d7e8f90 --short 24c093c",
+			expected:   "git show ${HASH} --short 24c093c",
+		},
+	} {
+		require.Equal(t, tc.expected, tc.normalizer(tc.command))
+		require.Equal(t, tc.expected, tc.normalizer(tc.expected)) // idempotent
+	}
+}
+
+func TestRecorderNormalizers(t *testing.T) {
+	dir := t.TempDir()
+	command := "ls " + dir
+
+	buffer := bytes.NewBuffer(nil)
+	recorder := New(WithRecording(buffer), WithNormalizer(NormalizeDir(dir, "TESTDIR")))
+	_, err := recorder.Next(command, func() (string, error) {
+		return "a\n", nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "ls ${TESTDIR}\n----\na\n\n", buffer.String())
+
+	// Play back using a different directory, as we would on a different run.
+	otherDir := filepath.Join(dir, "other")
+	replayer := New(WithReplay(buffer, "recording"), WithNormalizer(NormalizeDir(otherDir, "TESTDIR")))
+	output, err := replayer.Next("ls "+otherDir, nil)
+	require.NoError(t, err)
+	require.Equal(t, "a\n", output)
+}
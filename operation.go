@@ -18,55 +18,290 @@
 package recorder
 
 import (
+	"encoding/base64"
+	"fmt"
 	"strings"
+	"unicode/utf8"
 )
 
+// keepDirective is the comment used to annotate operations that are to be
+// preserved when re-recording (see WithPreserve).
+const keepDirective = "# keep"
+
 // operation represents the base unit of what can be recorded. It consists of a
 // command and the corresponding output.
 type operation struct {
 	command string // <command>
 	output  string // <output>
+
+	// isError is set if <output> is the message of an error returned when
+	// recording, as opposed to regular output.
+	isError bool
+
+	// comments are the comment lines (including the leading '#') immediately
+	// preceding <command>. keep is set if one of them is the keep directive.
+	comments []string
+	keep     bool
+
+	// detached are the comment lines preceding the operation that aren't
+	// attached to it, separated from it by a blank line. Blank lines
+	// separating them from each other are retained as empty strings.
+	detached []string
+
+	// line is the line number <command> was found on, if parsed out of a
+	// recording.
+	line int
+
+	// blob, if set, references the blob file <output> is stored in, in place
+	// of <output> itself (see WithBlobs).
+	blob string
+}
+
+// Operation is the exported form of an operation, as found in a recording (see
+// Parse and NewDecoder) or to be written out to one (see NewEncoder).
+type Operation struct {
+	Command string // <command>
+	Output  string // <output>
+
+	// Error is set if Output is the message of an error returned when
+	// recording, as opposed to regular output.
+	Error bool
+
+	// Comments are the comment lines (including the leading '#') immediately
+	// preceding the command.
+	Comments []string
+
+	// Detached are the comment lines preceding the operation that aren't
+	// attached to it, i.e. separated from it (and from the preceding
+	// operation) by blank lines. Blank lines separating them from each other
+	// are retained as empty strings.
+	Detached []string
+
+	// Blob references the blob file Output is stored in, if it's stored
+	// separately (see WithBlobs). Output is then empty.
+	Blob string
+
+	// Name and Line are the position of the operation in the recording it was
+	// read from: the name of the recording, and the line number of its
+	// command. They're zero otherwise.
+	Name string
+	Line int
+}
+
+// String returns the printable form of the operation (see TextFormat).
+func (o Operation) String() string {
+	op := o.internal()
+	return op.String()
+}
+
+// internal returns the internal form of the operation.
+func (o Operation) internal() operation {
+	op := operation{
+		command:  o.Command,
+		output:   o.Output,
+		isError:  o.Error,
+		comments: o.Comments,
+		detached: o.Detached,
+		blob:     o.Blob,
+		line:     o.Line,
+	}
+	for _, comment := range o.Comments {
+		if comment == keepDirective {
+			op.keep = true
+		}
+	}
+	return op
+}
+
+// export returns the exported form of the operation, read from the recording
+// with the given name.
+func (o *operation) export(name string) Operation {
+	return Operation{
+		Command:  o.command,
+		Output:   o.output,
+		Error:    o.isError,
+		Comments: o.comments,
+		Detached: o.detached,
+		Blob:     o.blob,
+		Name:     name,
+		Line:     o.line,
+	}
 }
 
 // String returns a printable form for the given operation, respecting the
 // pre-defined grammar (see the comment on Recorder for the grammar we're
-// constructing against).
+// constructing against). It picks the simplest form of <output> that survives
+// a round trip through the parser: the default form if possible, the double
+// separator form if the output contains blank lines, and a heredoc otherwise.
+// Binary output is base64 encoded.
 func (o *operation) String() string {
 	var sb strings.Builder
-	sb.WriteString(o.command)
+	if len(o.detached) > 0 {
+		sb.WriteString(detachedString(o.detached))
+		sb.WriteString("\n")
+	}
+	for _, comment := range o.comments {
+		sb.WriteString(comment)
+		sb.WriteString("\n")
+	}
+	sb.WriteString(wrapCommand(o.command))
 	sb.WriteString("\n")
 
 	sb.WriteString("----")
-	sb.WriteString("\n")
+	if o.isError {
+		sb.WriteString(" error")
+	}
+
+	switch {
+	case o.blob != "":
+		sb.WriteString(" blob ")
+		sb.WriteString(o.blob)
+		sb.WriteString("\n")
 
-	var emptyLine bool
-	if o.output != "" {
-		lines := strings.Split(strings.TrimRight(o.output, "\n"), "\n")
-		for _, line := range lines {
-			if line == "" {
-				emptyLine = true
-				break
-			}
+	case isBinaryOutput(o.output):
+		sb.WriteString(" base64")
+		sb.WriteString("\n")
+		encoded := base64.StdEncoding.EncodeToString([]byte(o.output))
+		for len(encoded) > encodedLineLength {
+			sb.WriteString(encoded[:encodedLineLength])
+			sb.WriteString("\n")
+			encoded = encoded[encodedLineLength:]
 		}
-	}
-	if emptyLine {
-		sb.WriteString("----")
+		sb.WriteString(encoded)
 		sb.WriteString("\n")
-	}
 
-	sb.WriteString(o.output)
-	if o.output != "" && !strings.HasSuffix(o.output, "\n") {
-		// If the output is not \n terminated, add it.
+	case isSimpleOutput(o.output):
 		sb.WriteString("\n")
-	}
+		sb.WriteString(o.output)
 
-	if emptyLine {
+	case isBlockOutput(o.output):
+		sb.WriteString("\n")
 		sb.WriteString("----")
 		sb.WriteString("\n")
+		sb.WriteString(o.output)
 		sb.WriteString("----")
 		sb.WriteString("\n")
+		sb.WriteString("----")
+		sb.WriteString("\n")
+
+	default:
+		terminator := heredocTerminator(o.output)
+		sb.WriteString(" <<")
+		sb.WriteString(terminator)
+		if !strings.HasSuffix(o.output, "\n") {
+			sb.WriteString(" noeol")
+		}
+		sb.WriteString("\n")
+		sb.WriteString(o.output)
+		if !strings.HasSuffix(o.output, "\n") {
+			sb.WriteString("\n")
+		}
+		sb.WriteString(terminator)
+		sb.WriteString("\n")
 	}
 
 	sb.WriteString("\n")
 	return sb.String()
 }
+
+// detachedString returns the printable form of the given detached comments.
+func detachedString(detached []string) string {
+	var sb strings.Builder
+	for _, line := range detached {
+		sb.WriteString(line)
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// commandLineLength is the length beyond which commands in their structured
+// form are wrapped (see wrapCommand).
+const commandLineLength = 80
+
+// wrapCommand returns the printable form of the given command. Commands in
+// their structured form (see Command) that are longer than commandLineLength
+// are wrapped onto the following lines, one argument per line. The parser
+// joins them back together (see parseOperation).
+//
+//   http method=POST \
+//     url=https://api.example.com/v1/items \
+//     body="{\"name\":\"a\"}"
+func wrapCommand(command string) string {
+	if len(command) <= commandLineLength {
+		return command
+	}
+	cmd, err := ParseCommand(command)
+	if err != nil || len(cmd.Args) < 2 || cmd.String() != command {
+		// It's not in its structured form, or there's nothing to wrap. It's
+		// printed as is.
+		return command
+	}
+
+	var sb strings.Builder
+	sb.WriteString(cmd.name())
+	for i, arg := range cmd.Args {
+		if i > 0 {
+			sb.WriteString(" \\\n ")
+		}
+		sb.WriteString(" ")
+		sb.WriteString(arg.String())
+	}
+	return sb.String()
+}
+
+// encodedLineLength is the length encoded <output> is wrapped at.
+const encodedLineLength = 76
+
+// isBinaryOutput returns whether the given output is to be printed in its
+// encoded form, as opposed to verbatim. That's the case for output that's not
+// valid UTF-8, or that contains NUL bytes.
+func isBinaryOutput(output string) bool {
+	return !utf8.ValidString(output) || strings.IndexByte(output, 0) >= 0
+}
+
+// isSimpleOutput returns whether the given output can be printed in the
+// default form, terminated by the first blank line.
+func isSimpleOutput(output string) bool {
+	if output == "" {
+		return true
+	}
+	if !strings.HasSuffix(output, "\n") {
+		return false
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(output, "\n"), "\n") {
+		if strings.TrimSpace(line) == "" || isSeparator(line) {
+			return false
+		}
+	}
+	return true
+}
+
+// isBlockOutput returns whether the given output can be printed in the double
+// separator form, allowing for blank lines.
+func isBlockOutput(output string) bool {
+	if !strings.HasSuffix(output, "\n") {
+		return false
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(output, "\n"), "\n") {
+		if isSeparator(line) {
+			return false
+		}
+	}
+	return true
+}
+
+// heredocTerminator returns a terminator for the given output when printed as a
+// heredoc, one that doesn't appear as a line of its own in the output.
+func heredocTerminator(output string) string {
+	lines := make(map[string]struct{})
+	for _, line := range strings.Split(output, "\n") {
+		lines[strings.TrimSuffix(line, "\r")] = struct{}{}
+	}
+	terminator := "EOF"
+	for i := 1; ; i++ {
+		if _, ok := lines[terminator]; !ok {
+			return terminator
+		}
+		terminator = fmt.Sprintf("EOF%d", i)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package osfs provides the common filesystem functions of package os,
+// recorded and replayed through a recorder.Recorder.
+//
+// Operations are recorded in the structured form (see recorder.Command), as are
+// file info and errors:
+//
+//   stat path=/src/recorder/go.mod
+//   ----
+//   file name=go.mod size=34 mode=-rw-r--r-- modtime=2021-03-12T11:51:30Z
+//
+//   read-file path=/src/recorder/go.sum
+//   ---- error
+//   path-error op=open err="no such file or directory" is="file does not exist"
+//
+// Replayed values are indistinguishable from real ones, with the exception of
+// fs.FileInfo.Sys, which is always nil. Errors are replayed as *fs.PathError
+// (or *os.LinkError), wrapping the original syscall.Errno where possible (see
+// recorder.DoFS).
+package osfs
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/irfansharif/recorder"
+)
+
+// OS provides the common filesystem functions of package os, recorded or
+// replayed through the Recorder it was constructed with. If nil, they're simply
+// passed through.
+type OS struct {
+	r *recorder.Recorder
+}
+
+// New returns an OS that records or replays through the given Recorder.
+func New(r *recorder.Recorder) *OS {
+	return &OS{r: r}
+}
+
+// MkdirAll is like os.MkdirAll.
+func (o *OS) MkdirAll(path string, perm fs.FileMode) error {
+	cmd := recorder.Cmd("mkdir-all", recorder.KV("path", path), recorder.KV("perm", octal(perm)))
+	return o.exec(cmd, func() error {
+		return os.MkdirAll(path, perm)
+	})
+}
+
+// Remove is like os.Remove.
+func (o *OS) Remove(name string) error {
+	return o.exec(recorder.Cmd("remove", recorder.KV("path", name)), func() error {
+		return os.Remove(name)
+	})
+}
+
+// RemoveAll is like os.RemoveAll.
+func (o *OS) RemoveAll(path string) error {
+	return o.exec(recorder.Cmd("remove-all", recorder.KV("path", path)), func() error {
+		return os.RemoveAll(path)
+	})
+}
+
+// Rename is like os.Rename.
+func (o *OS) Rename(oldpath, newpath string) error {
+	cmd := recorder.Cmd("rename", recorder.KV("old", oldpath), recorder.KV("new", newpath))
+	return o.exec(cmd, func() error {
+		return os.Rename(oldpath, newpath)
+	})
+}
+
+// Symlink is like os.Symlink.
+func (o *OS) Symlink(oldname, newname string) error {
+	cmd := recorder.Cmd("symlink", recorder.KV("old", oldname), recorder.KV("new", newname))
+	return o.exec(cmd, func() error {
+		return os.Symlink(oldname, newname)
+	})
+}
+
+// Chmod is like os.Chmod.
+func (o *OS) Chmod(name string, mode fs.FileMode) error {
+	cmd := recorder.Cmd("chmod", recorder.KV("path", name), recorder.KV("mode", octal(mode)))
+	return o.exec(cmd, func() error {
+		return os.Chmod(name, mode)
+	})
+}
+
+// WriteFile is like os.WriteFile. The data written is recorded as part of the
+// command.
+func (o *OS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	cmd := recorder.Cmd("write-file",
+		recorder.KV("path", name), recorder.KV("perm", octal(perm)), recorder.KV("data", string(data)))
+	return o.exec(cmd, func() error {
+		return os.WriteFile(name, data, perm)
+	})
+}
+
+// Readlink is like os.Readlink.
+func (o *OS) Readlink(name string) (string, error) {
+	return do(o, recorder.Cmd("readlink", recorder.KV("path", name)), func() (string, error) {
+		return os.Readlink(name)
+	}, func(target string) (string, error) {
+		return recorder.Text().Encode(target + "\n")
+	}, func(s string) (string, error) {
+		target, err := recorder.Text().Decode(s)
+		return strings.TrimSuffix(target, "\n"), err
+	})
+}
+
+// ReadFile is like os.ReadFile. The contents of the file are recorded as is.
+func (o *OS) ReadFile(name string) ([]byte, error) {
+	return do(o, recorder.Cmd("read-file", recorder.KV("path", name)), func() ([]byte, error) {
+		return os.ReadFile(name)
+	}, func(data []byte) (string, error) {
+		return string(data), nil
+	}, func(s string) ([]byte, error) {
+		return []byte(s), nil
+	})
+}
+
+// Stat is like os.Stat.
+func (o *OS) Stat(name string) (fs.FileInfo, error) {
+	return do(o, recorder.Cmd("stat", recorder.KV("path", name)), func() (fs.FileInfo, error) {
+		return os.Stat(name)
+	}, recorder.FileInfo().Encode, recorder.FileInfo().Decode)
+}
+
+// ReadDir is like os.ReadDir. If an error occurs reading the directory, no
+// entries are returned.
+func (o *OS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return do(o, recorder.Cmd("read-dir", recorder.KV("path", name)), func() ([]fs.DirEntry, error) {
+		return os.ReadDir(name)
+	}, recorder.DirEntries().Encode, recorder.DirEntries().Decode)
+}
+
+// exec records or replays an operation that only returns an error.
+func (o *OS) exec(cmd recorder.Command, f func() error) error {
+	_, err := do(o, cmd, func() (struct{}, error) {
+		return struct{}{}, f()
+	}, func(struct{}) (string, error) {
+		return "", nil
+	}, func(string) (struct{}, error) {
+		return struct{}{}, nil
+	})
+	return err
+}
+
+// do is a wrapper around recorder.DoFS, using the OS's Recorder (if any).
+func do[T any](
+	o *OS,
+	cmd recorder.Command,
+	f func() (T, error),
+	encode func(T) (string, error),
+	decode func(string) (T, error),
+) (T, error) {
+	var r *recorder.Recorder
+	if o != nil {
+		r = o.r
+	}
+	return recorder.DoFS(r, cmd, f, encode, decode)
+}
+
+// octal returns the octal form of the given mode.
+func octal(mode fs.FileMode) string {
+	return fmt.Sprintf("%#o", uint32(mode))
+}
@@ -0,0 +1,177 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package osfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/irfansharif/recorder"
+	"github.com/stretchr/testify/require"
+)
+
+// run exercises the given OS with a set of operations, returning a description
+// of their results.
+func run(t *testing.T, o *OS, dir string) []string {
+	var results []string
+	describe := func(v interface{}, err error) {
+		switch v := v.(type) {
+		case fs.FileInfo:
+			if v != nil {
+				results = append(results, describeFileInfo(v))
+				return
+			}
+		case []fs.DirEntry:
+			var names []string
+			for _, entry := range v {
+				info, err := entry.Info()
+				require.NoError(t, err)
+				require.Equal(t, entry.Type(), info.Mode().Type())
+				names = append(names, describeFileInfo(info))
+			}
+			results = append(results, strings.Join(names, "; "))
+			return
+		case []byte:
+			v = []byte(string(v)) // normalize nil and empty slices
+			results = append(results, fmt.Sprintf("%q %#v", v, err))
+			return
+		}
+		results = append(results, fmt.Sprintf("%#v %#v", v, err))
+	}
+
+	nested, file := filepath.Join(dir, "a", "b"), filepath.Join(dir, "a", "b", "file")
+	modtime := time.Date(2021, 3, 12, 11, 51, 30, 0, time.UTC)
+	describe(nil, o.MkdirAll(nested, 0755))
+	describe(nil, o.WriteFile(file, []byte("hello\n"), 0644))
+	describe(nil, o.Chmod(file, 0600))
+	_ = os.Chtimes(file, modtime, modtime) // unrecorded; fails when replaying
+	describe(o.Stat(file))
+	describe(o.ReadDir(nested))
+	describe(o.ReadFile(file))
+	describe(nil, o.Symlink("file", filepath.Join(nested, "link")))
+	describe(o.Readlink(filepath.Join(nested, "link")))
+	describe(nil, o.Rename(file, filepath.Join(nested, "renamed")))
+	describe(o.ReadFile(file))
+	describe(o.Stat(file))
+	describe(o.ReadDir(file))
+	describe(nil, o.Rename(file, filepath.Join(nested, "renamed")))
+	describe(nil, o.Remove(filepath.Join(dir, "a")))
+	describe(nil, o.RemoveAll(filepath.Join(dir, "a")))
+
+	_, err := o.ReadFile(file)
+	require.True(t, errors.Is(err, fs.ErrNotExist))
+	return results
+}
+
+func describeFileInfo(info fs.FileInfo) string {
+	return fmt.Sprintf("name=%s size=%d mode=%s modtime=%s dir=%t",
+		info.Name(), info.Size(), info.Mode(), info.ModTime().UTC(), info.IsDir())
+}
+
+func TestOS(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "dir")
+	require.NoError(t, os.Mkdir(dir, 0755))
+
+	// Record the real thing.
+	var buffer bytes.Buffer
+	r := recorder.New(recorder.WithRecording(&buffer), recorder.WithNormalizer(recorder.NormalizeDir(dir, "DIR")))
+	recorded := run(t, New(r), dir)
+	require.NoDirExists(t, filepath.Join(dir, "a"))
+
+	expected := `
+mkdir-all path=${DIR}/a/b perm=0755
+----
+
+write-file path=${DIR}/a/b/file perm=0644 data="hello\n"
+----
+
+chmod path=${DIR}/a/b/file mode=0600
+----
+
+stat path=${DIR}/a/b/file
+----
+file name=file size=6 mode=-rw------- modtime=2021-03-12T11:51:30Z
+
+read-dir path=${DIR}/a/b
+----
+file name=file size=6 mode=-rw------- modtime=2021-03-12T11:51:30Z
+
+read-file path=${DIR}/a/b/file
+----
+hello
+
+symlink old=file new=${DIR}/a/b/link
+----
+
+readlink path=${DIR}/a/b/link
+----
+file
+
+rename old=${DIR}/a/b/file new=${DIR}/a/b/renamed
+----
+
+read-file path=${DIR}/a/b/file
+---- error
+path-error op=open err="no such file or directory" is="file does not exist"
+
+stat path=${DIR}/a/b/file
+---- error
+path-error op=stat err="no such file or directory" is="file does not exist"
+
+read-dir path=${DIR}/a/b/file
+---- error
+path-error op=open err="no such file or directory" is="file does not exist"
+
+rename old=${DIR}/a/b/file new=${DIR}/a/b/renamed
+---- error
+link-error op=rename err="no such file or directory" is="file does not exist"
+
+remove path=${DIR}/a
+---- error
+path-error op=remove err="directory not empty" is="file already exists"
+
+remove-all path=${DIR}/a
+----
+
+read-file path=${DIR}/a/b/file
+---- error
+path-error op=open err="no such file or directory" is="file does not exist"
+
+`
+	recording := buffer.String()
+	// The modification time is recorded in the local time zone.
+	recording = strings.ReplaceAll(recording, localModTime(), "2021-03-12T11:51:30Z")
+	require.Equal(t, strings.TrimLeft(expected, "\n"), recording)
+
+	// Play it back, without touching the filesystem.
+	r = recorder.New(recorder.WithReplay(&buffer, "recording"), recorder.WithNormalizer(recorder.NormalizeDir(dir, "DIR")))
+	require.Equal(t, recorded, run(t, New(r), dir))
+	require.NoDirExists(t, filepath.Join(dir, "a"))
+	require.NoError(t, r.Close())
+
+	// Simply run it, without a Recorder.
+	require.Equal(t, recorded, run(t, New(nil), dir))
+}
+
+func localModTime() string {
+	return time.Date(2021, 3, 12, 11, 51, 30, 0, time.UTC).Local().Format(time.RFC3339Nano)
+}
@@ -16,24 +16,43 @@ package recorder
 
 import (
 	"bytes"
-	"errors"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"strings"
+	"unicode"
 )
 
 // parseOperation parses out the next operation from the internal scanner. See
 // top-level comment on Recorder to understand the grammar we're parsing
 // against.
 func (r *Recorder) parseOperation() (parsed bool, err error) {
+	var comments, detached []string
 	for r.scanner.Scan() {
-		r.op = operation{}
+		r.op = operation{line: r.scanner.line}
 		line := r.scanner.Text()
 
 		line = strings.TrimSpace(line)
 		if strings.HasPrefix(line, "#") {
-			// Skip comment lines.
+			// Collect comment lines, attaching them to the command that
+			// immediately follows.
+			comments = append(comments, line)
 			continue
 		}
+		if line == "" {
+			// Comments separated from the command by a blank line are not
+			// attached to it, though they're retained all the same.
+			detached = detach(detached, comments)
+			comments = nil
+			continue
+		}
+		r.op.comments = comments
+		r.op.detached = detached
+		for _, comment := range comments {
+			if comment == keepDirective {
+				r.op.keep = true
+			}
+		}
 
 		// Support wrapping command directive lines using "\".
 		for strings.HasSuffix(line, `\`) && r.scanner.Scan() {
@@ -53,19 +72,57 @@ func (r *Recorder) parseOperation() (parsed bool, err error) {
 		}
 		r.op.command = command
 
-		if err := r.parseSeparator(); err != nil {
+		h, err := r.parseHeader()
+		if err != nil {
 			return false, err
 		}
 
+		if h.blob != "" {
+			// The output is stored elsewhere. Read the following blank line.
+			r.op.blob = h.blob
+			if r.scanner.Scan() && strings.TrimSpace(r.scanner.Text()) != "" {
+				return false, r.scanner.errorf("non-blank line after blob reference")
+			}
+			return true, nil
+		}
+		if h.encoding != "" {
+			if err := r.parseEncoded(h); err != nil {
+				return false, err
+			}
+			return true, nil
+		}
+		if h.heredoc != "" {
+			if err := r.parseHeredoc(h); err != nil {
+				return false, err
+			}
+			return true, nil
+		}
 		if err := r.parseOutput(); err != nil {
 			return false, err
 		}
 
 		return true, nil
 	}
+
+	// Comments following the last operation are retained too.
+	if trailing := detach(detached, comments); trailing != nil {
+		r.trailing = trailing
+	}
 	return false, nil
 }
 
+// detach appends the given comment lines to the detached ones, separated by a
+// blank line.
+func detach(detached, comments []string) []string {
+	if len(comments) == 0 {
+		return detached
+	}
+	if len(detached) > 0 {
+		detached = append(detached, "")
+	}
+	return append(detached, comments...)
+}
+
 // parseCommand parses a <command> line and returns it if parsed correctly. See
 // top-level comment on Recorder to understand the grammar we're parsing
 // against.
@@ -74,14 +131,154 @@ func (r *Recorder) parseCommand(line string) (cmd string, err error) {
 	if line == "" {
 		return "", nil
 	}
+	return line, nil
+}
+
+// header captures the annotations on the separator following a <command>.
+type header struct {
+	// heredoc is the terminator for <output>, if it's a heredoc ('----
+	// <<EOF').
+	heredoc string
+	// noeol is set if the heredoc's <output> is not newline terminated
+	// ('---- <<EOF noeol').
+	noeol bool
+	// encoding is the encoding of <output>, if it's encoded ('---- base64' or
+	// '---- hex').
+	encoding string
+	// blob references the blob file <output> is stored in, if it's stored
+	// separately ('---- blob sha256:<hash>').
+	blob string
+}
+
+// parseHeader parses the separator following a <command>, which could be
+// annotated ('---- error') to indicate that the <output> that follows is an
+// error, and/or ('---- <<EOF') to indicate that it's a heredoc, or ('----
+// base64') to indicate that it's encoded, or ('---- blob sha256:<hash>') to
+// indicate that it's stored in a separate blob file. See top-level comment on
+// Recorder to understand the grammar we're parsing against.
+func (r *Recorder) parseHeader() (header, error) {
+	if !r.scanner.Scan() {
+		return header{}, r.scanner.errorf("expected to find separator after command")
+	}
+	line := r.scanner.Text()
+	fields, columns := fieldsWithColumns(line)
+	if len(fields) == 0 || fields[0] != "----" {
+		return header{}, r.scanner.errorf("expected to find separator after command, found %q instead", line)
+	}
 
-	origLine := line
-	cmd = strings.TrimSpace(line)
-	if cmd == "" {
-		column := len(origLine) - len(line) + 1
-		return "", errors.New(fmt.Sprintf("%s: cannot parse command at col %d: %s", r.scanner.pos(), column, origLine))
+	// The columns of the annotations, for the purposes of error messages.
+	var h header
+	var noeolColumn, encodingColumn, blobColumn int
+	for i := 1; i < len(fields); i++ {
+		field := fields[i]
+		switch {
+		case field == "error":
+			r.op.isError = true
+		case field == "noeol":
+			h.noeol, noeolColumn = true, columns[i]
+		case field == "base64" || field == "hex":
+			h.encoding, encodingColumn = field, columns[i]
+		case field == "blob":
+			if i+1 == len(fields) || !isBlobRef(fields[i+1]) {
+				return header{}, r.scanner.columnErrorf(columns[i],
+					"expected blob reference (%s<hash>) after separator annotation \"blob\"", blobPrefix)
+			}
+			h.blob, blobColumn = fields[i+1], columns[i]
+			i++
+		case strings.HasPrefix(field, "<<") && len(field) > len("<<"):
+			h.heredoc = strings.TrimPrefix(field, "<<")
+		default:
+			return header{}, r.scanner.columnErrorf(columns[i], "unrecognized separator annotation %q", field)
+		}
+	}
+	if h.noeol && h.heredoc == "" {
+		return header{}, r.scanner.columnErrorf(noeolColumn, "separator annotation \"noeol\" is only valid for heredocs")
+	}
+	if h.encoding != "" && h.heredoc != "" {
+		return header{}, r.scanner.columnErrorf(encodingColumn, "separator annotation %q is not valid for heredocs", h.encoding)
 	}
-	return cmd, nil
+	if h.blob != "" && (h.encoding != "" || h.heredoc != "") {
+		return header{}, r.scanner.columnErrorf(blobColumn, "separator annotation \"blob\" is not valid alongside inline output")
+	}
+	return h, nil
+}
+
+// fieldsWithColumns is like strings.Fields, also returning the (1-indexed)
+// column each field starts at.
+func fieldsWithColumns(line string) (fields []string, columns []int) {
+	start := -1
+	for i, r := range line + " " {
+		if unicode.IsSpace(r) {
+			if start >= 0 {
+				fields, columns = append(fields, line[start:i]), append(columns, start+1)
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	return fields, columns
+}
+
+// parseEncoded parses an encoded <output>, terminated by the first blank line.
+// Whitespace within the encoded form is ignored. See top-level comment on
+// Recorder to understand the grammar we're parsing against.
+func (r *Recorder) parseEncoded(h header) error {
+	var buf strings.Builder
+	for r.scanner.Scan() {
+		line := r.scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			break
+		}
+		for _, field := range strings.Fields(line) {
+			buf.WriteString(field)
+		}
+	}
+
+	var decoded []byte
+	var err error
+	switch h.encoding {
+	case "base64":
+		decoded, err = base64.StdEncoding.DecodeString(buf.String())
+	case "hex":
+		decoded, err = hex.DecodeString(buf.String())
+	}
+	if err != nil {
+		return r.scanner.errorf("unable to decode %s output: %v", h.encoding, err)
+	}
+	r.op.output = string(decoded)
+	return nil
+}
+
+// parseHeredoc parses a heredoc <output>, terminated by a line consisting of
+// just the terminator specified in the header. See top-level comment on
+// Recorder to understand the grammar we're parsing against.
+func (r *Recorder) parseHeredoc(h header) error {
+	var buf bytes.Buffer
+	for r.scanner.Scan() {
+		line := r.scanner.Text()
+		if strings.TrimSuffix(line, "\r") != h.heredoc {
+			buf.WriteString(line)
+			buf.WriteString("\n")
+			continue
+		}
+
+		// We just saw the terminator, the output portion is done. Read the
+		// following blank line.
+		if r.scanner.Scan() && strings.TrimSpace(r.scanner.Text()) != "" {
+			return r.scanner.errorf("non-blank line after end of heredoc")
+		}
+		r.op.output = buf.String()
+		if h.noeol {
+			r.op.output = strings.TrimSuffix(r.op.output, "\n")
+		}
+		return nil
+	}
+
+	// We reached the end of the file before finding the terminator.
+	return r.scanner.errorf("missing heredoc terminator %q", h.heredoc)
 }
 
 // parseSeparator parses a separator ('----'), erroring out if it's not parsed
@@ -89,15 +286,21 @@ func (r *Recorder) parseCommand(line string) (cmd string, err error) {
 // parsing against.
 func (r *Recorder) parseSeparator() error {
 	if !r.scanner.Scan() {
-		return errors.New(fmt.Sprintf("%s: expected to find separator after command", r.scanner.pos()))
+		return r.scanner.errorf("expected to find separator after command")
 	}
 	line := r.scanner.Text()
-	if line != "----" {
-		return errors.New(fmt.Sprintf("%s: expected to find separator after command, found %q instead", r.scanner.pos(), line))
+	if !isSeparator(line) {
+		return r.scanner.errorf("expected to find separator after command, found %q instead", line)
 	}
 	return nil
 }
 
+// isSeparator returns whether the given line is a separator ('----'),
+// disregarding any trailing carriage return.
+func isSeparator(line string) bool {
+	return strings.TrimSuffix(line, "\r") == "----"
+}
+
 // parseOutput parses an <output>. See top-level comment on Recorder to
 // understand the grammar we're parsing against.
 func (r *Recorder) parseOutput() error {
@@ -107,7 +310,7 @@ func (r *Recorder) parseOutput() error {
 	var allowBlankLines bool
 	if r.scanner.Scan() {
 		line = r.scanner.Text()
-		if line == "----" {
+		if isSeparator(line) {
 			allowBlankLines = true
 		}
 	}
@@ -136,7 +339,7 @@ func (r *Recorder) parseOutput() error {
 	// Look for two successive lines of "----" before terminating.
 	for r.scanner.Scan() {
 		line = r.scanner.Text()
-		if line != "----" {
+		if !isSeparator(line) {
 			// We just picked up a regular line that's part of the command
 			// output.
 			if _, err := fmt.Fprintln(&buf, line); err != nil {
@@ -152,8 +355,8 @@ func (r *Recorder) parseOutput() error {
 		if err := r.parseSeparator(); err == nil {
 			// We just saw the second separator, the output portion is done.
 			// Read the following blank line.
-			if r.scanner.Scan() && r.scanner.Text() != "" {
-				return errors.New(fmt.Sprintf("%s: non-blank line after end of double ---- separator section", r.scanner.pos()))
+			if r.scanner.Scan() && strings.TrimSpace(r.scanner.Text()) != "" {
+				return r.scanner.errorf("non-blank line after end of double ---- separator section")
 			}
 			r.op.output = buf.String()
 			return nil
@@ -173,11 +376,5 @@ func (r *Recorder) parseOutput() error {
 	}
 
 	// We reached the end of the file before finding the closing separator.
-	return errors.New(fmt.Sprintf("%s: missing closing double ---- separators", r.scanner.pos()))
+	return r.scanner.errorf("missing closing double ---- separators")
 }
-
-// TODO(irfansharif): We could introduce a `# keep` directive to pin recordings
-// on re-write. It raises a few questions around how new recordings get merged
-// with existing ones, but it could be useful. It would allow test authors to
-// trim down auto-generated mocks by hand for readability, and ensure that
-// re-writes don't simply undo the work.
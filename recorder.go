@@ -22,6 +22,9 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"sort"
+	"strings"
+	"sync"
 )
 
 // Recorder can be used to record a set of operations (defined only by a
@@ -87,9 +90,9 @@ import (
 // Once the recordings are captured, they can be edited and maintained by hand.
 // An example of where we might want to do this is for recordings for commands
 // that generate copious amounts of output. It suffices for us to trim the
-// recording down by hand, and make sure we don't re-record over it (by
-// inspecting the diffs during review). Recordings, like other mocks, are also
-// expected to get checked in as test data fixtures.
+// recording down by hand, and annotate it with a "# keep" comment to make sure
+// we don't re-record over it (see WithPreserve). Recordings, like other mocks,
+// are also expected to get checked in as test data fixtures.
 //
 // ---
 //
@@ -102,6 +105,13 @@ import (
 //   ----
 //   <output>
 //
+// Comments immediately preceding a command are attached to it. Comments
+// separated from commands by blank lines (say, a header at the top of the
+// recording, or notes at the end of it) are retained in place all the same.
+//
+// Long commands in their structured form (see Command) are wrapped this way
+// when recorded, one argument per line.
+//
 // By default <output> cannot contain blank lines. This alternative syntax
 // allows the use of blank lines.
 //
@@ -114,8 +124,41 @@ import (
 //   ----
 //   ----
 //
-// Callers are free to use <output> to model errors as well; it's all opaque to
-// Recorders.
+// Output that can't be represented by either form (output that isn't newline
+// terminated, or that contains lines that would be mistaken for separators,
+// etc.) is recorded as a heredoc, delimited by a terminator of our choosing
+// that doesn't otherwise appear in the output. A "noeol" annotation indicates
+// that the output does not end with a newline.
+//
+//   <command>
+//   ---- <<EOF [noeol]
+//   <output>
+//   EOF
+//
+// Binary output (output that's not valid UTF-8, or that contains NUL bytes) is
+// recorded in an encoded form, wrapped over multiple lines and terminated by a
+// blank line. Hand-written recordings can also make use of hex encoding; in
+// either case whitespace within the encoded form is ignored.
+//
+//   <command>
+//   ---- base64|hex
+//   <encoded output>
+//
+// Large outputs can also be stored in separate files, referenced by their
+// hash (see WithBlobs):
+//
+//   <command>
+//   ---- blob sha256:<hash>
+//
+// Errors returned when recording are captured in place of <output>, annotated
+// as such:
+//
+//   <command>
+//   ---- error
+//   <error message>
+//
+// Callers are also free to use <output> to model errors as well; it's all
+// opaque to Recorders.
 type Recorder struct {
 	// writer is set if we're in recording mode, and is where operations are
 	// recorded.
@@ -126,13 +169,103 @@ type Recorder struct {
 	// parse out the current operation being read.
 	scanner *scanner
 	op      operation
+
+	// trailing are the comment lines found at the end of the recording, after
+	// the last operation, if any. Blank lines separating them are retained as
+	// empty strings.
+	trailing []string
+
+	// fatal is set if errors encountered by Next are to be treated as fatal
+	// (see WithFatalOnError).
+	fatal bool
+
+	// reporter, if set, is what errors encountered by Next are reported
+	// through (see WithReporter).
+	reporter Reporter
+
+	// concurrent is set if the recorder is to be used from multiple goroutines
+	// (see WithConcurrency). When recording, operations are then accumulated
+	// in buffered until flushed.
+	concurrent bool
+	buffered   []operation
+
+	// reserved are the positions in the recording reserved for operations
+	// that are yet to be recorded (see Reserve), followed by the operations
+	// recorded since that are held back until they're filled in.
+	reserved []*reservation
+
+	// matching determines how commands are matched against the recording when
+	// replaying (see WithMatching). For Unordered matching, the recording is
+	// loaded into index, which is then used to look up operations by command.
+	matching Matching
+	index    *index
+
+	// preserve is set if operations annotated with the keep directive in an
+	// earlier recording are to be preserved when recording (see
+	// WithPreserve). They're loaded into pinned, which is then used to look
+	// up operations by command.
+	preserve *Recorder
+	pinned   *index
+
+	// merge is set if we're only recording operations missing from an earlier
+	// recording (see WithRecordMissing). Its operations are loaded into
+	// existing, which is then used to look up operations by command.
+	merge    *Recorder
+	existing *index
+
+	// warnf is used to emit warnings, say for pinned operations that are no
+	// longer exercised.
+	warnf func(format string, args ...interface{})
+
+	// matcher, if set, is used to match commands against recorded ones (see
+	// WithMatcher).
+	matcher Matcher
+
+	// normalizers are applied to commands provided to Next (see
+	// WithNormalizer).
+	normalizers []Normalizer
+
+	// redactors are applied to commands and outputs (see WithRedactor).
+	redactors []Redactor
+
+	// sentinels are errors that errors replayed from the recording are
+	// matched against (see WithErrors).
+	sentinels []error
+
+	// blobs is the directory large outputs are stored in, if any; outputs
+	// larger than blobThreshold are stored there when recording (see
+	// WithBlobs and WithBlobThreshold).
+	blobs         string
+	blobThreshold int
+
+	// compressor, if set, wraps the writer the recording is written to,
+	// compressing it (see WithGzip and WithZstd).
+	compressor func(io.Writer) io.WriteCloser
+
+	// format is what the recording is serialized as, TextFormat if unset
+	// (see WithFormat).
+	format Format
+
+	// mu serializes access to everything above, allowing Next to be called
+	// concurrently.
+	mu sync.Mutex
 }
 
-// New constructs a Recorder, using the specified configuration option (either
-// WithReplay or WithRecording).
-func New(opt Option) *Recorder {
-	r := &Recorder{}
-	opt(r)
+// New constructs a Recorder, using the specified configuration options (one of
+// WithReplay or WithRecording, and optionally WithFatalOnError).
+func New(opts ...Option) *Recorder {
+	r := &Recorder{warnf: log.Printf}
+	for _, opt := range opts {
+		opt(r)
+	}
+	for _, earlier := range []*Recorder{r.preserve, r.merge} {
+		if earlier != nil {
+			earlier.format = r.format
+		}
+	}
+	if r.compressor != nil && r.writer != nil {
+		r.writer = &compressWriter{WriteCloser: r.compressor(r.writer), underlying: r.writer}
+	}
 	return r
 }
 
@@ -141,10 +274,11 @@ type Option func(r *Recorder)
 
 // WithReplay is used to configure a Recorder to play back from the given
 // io.Reader. The provided name is used only for diagnostic purposes, it's
-// typically the name of the recording file being read.
+// typically the name of the recording file being read. Compressed recordings
+// are decompressed transparently (see WithGzip and WithZstd).
 func WithReplay(from io.Reader, name string) Option {
 	return func(re *Recorder) {
-		re.scanner = newScanner(from, name)
+		re.scanner = newScanner(&decompressor{underlying: from}, name)
 	}
 }
 
@@ -156,6 +290,132 @@ func WithRecording(to io.Writer) Option {
 	}
 }
 
+// WithPreserve is used to configure a Recorder (set to record) to preserve
+// operations annotated with the keep directive in the given (earlier)
+// recording. It's typically the recording file being re-recorded into, read
+// before it's truncated. The provided name is used only for diagnostic
+// purposes.
+//
+//   # keep
+//   <command>
+//   ----
+//   <hand-edited output>
+//
+// When recording, commands are matched against the first pinned operation
+// with an identical command that's yet to be matched. If found, the callback
+// is still executed (for any side-effects), but it's the pinned operation
+// that gets recorded verbatim and whose output (or error) is returned. Pinned
+// operations that are not exercised are dropped with a warning (see Flush).
+// If the earlier recording is malformed, the error is returned by the first
+// call to Next (or Flush), after which recording proceeds without preserving
+// anything.
+func WithPreserve(from io.Reader, name string) Option {
+	return func(r *Recorder) {
+		r.preserve = New(WithReplay(from, name))
+	}
+}
+
+// WithRecordMissing is used to configure a Recorder to play back operations
+// found in the given (earlier) recording, and only record the ones missing from
+// it. Commands are matched against the first operation in the earlier
+// recording with an identical command that's yet to be played back; if none
+// is found, the callback is executed and its output recorded. The provided
+// name is used only for diagnostic purposes.
+//
+// The merged recording is written out to the given io.Writer on Flush. It
+// consists of all played back and newly recorded operations (in the order
+// they were executed in), followed by the operations in the earlier recording
+// that were not played back. Comments in the earlier recording are retained:
+// ones attached to (or otherwise preceding) operations along with them, and
+// ones at the end of the recording at the end. Given the merged recording is
+// only written out on Flush, the io.Writer can safely point to the same file
+// the earlier recording was read from, as long as it's read in full (and
+// closed) first.
+func WithRecordMissing(from io.Reader, name string, to io.Writer) Option {
+	return func(r *Recorder) {
+		r.merge = New(WithReplay(from, name))
+		r.writer = to
+	}
+}
+
+// WithFatalOnError is used to configure a Recorder to log.Fatal when it runs
+// into an error (say, a mismatched command when replaying), instead of
+// returning it from Next. Errors returned by the callback provided to Next are
+// never considered fatal.
+func WithFatalOnError() Option {
+	return func(r *Recorder) {
+		r.fatal = true
+	}
+}
+
+// WithConcurrency is used to configure a Recorder for use by components that
+// call Next from multiple goroutines, where the order of operations is
+// nondeterministic. When recording, operations are buffered and written out
+// (on Flush) ordered by command, and then by output, keeping recordings stable
+// across runs. When replaying, operations are matched using Unordered
+// matching, tolerating any interleaving of calls across goroutines.
+func WithConcurrency() Option {
+	return func(r *Recorder) {
+		r.concurrent = true
+		r.matching = Unordered
+	}
+}
+
+// Reporter is what a Recorder reports errors and warnings through, if
+// configured using WithReporter. It's satisfied by testing.TB.
+type Reporter interface {
+	Helper()
+	Fatalf(format string, args ...interface{})
+	Logf(format string, args ...interface{})
+}
+
+// WithReporter is used to configure a Recorder to report errors encountered by
+// Next (mismatched commands, malformed recordings, etc.) using Fatalf, and to
+// emit warnings using Logf. If Fatalf returns, the error is also returned from
+// Next. It's typically used with a testing.TB (see package rectest).
+func WithReporter(rep Reporter) Option {
+	return func(r *Recorder) {
+		r.reporter = rep
+		r.warnf = rep.Logf
+	}
+}
+
+// Matching determines how commands provided to Next are matched against
+// operations in the recording, when replaying.
+type Matching int
+
+const (
+	// Ordered matching requires commands to be identical to the next operation
+	// in the recording, i.e. operations are played back in the order they were
+	// recorded in. This is the default.
+	Ordered Matching = iota
+	// Unordered matching looks up the first operation in the recording with
+	// an identical command that's yet to be played back. It's useful for
+	// recordings of idempotent lookups, where the order they're made in is
+	// immaterial.
+	Unordered
+)
+
+// WithMatching is used to configure how a Recorder matches commands against
+// operations in the recording when replaying (see Matching).
+func WithMatching(m Matching) Option {
+	return func(r *Recorder) {
+		r.matching = m
+	}
+}
+
+// WithErrors is used to register sentinel errors with a Recorder, allowing
+// errors replayed from a recording to retain their identity. A replayed error
+// wraps the first registered error whose message it either matches or ends
+// with (following a ": "), so for example a recorded "open foo: file does not
+// exist" satisfies errors.Is(err, fs.ErrNotExist) if fs.ErrNotExist is
+// registered.
+func WithErrors(sentinels ...error) Option {
+	return func(r *Recorder) {
+		r.sentinels = append(r.sentinels, sentinels...)
+	}
+}
+
 // Next is used to step through the next operation in the recorder. It does one
 // of three things, depending on how the recorder is configured.
 //  a. If the recorder is nil (i.e. it's simply not configured), it will
@@ -163,73 +423,517 @@ func WithRecording(to io.Writer) Option {
 //  b. WithRecording records the given command and output (captured by the
 //     provided callback);
 //  c. WithReplay replays the next command in the recording, as long as it's
-//     identical to the provided one.
+//     identical to the provided one (see WithMatching for alternatives).
+//
+// Next is safe for concurrent use, though see WithConcurrency for recordings
+// that are stable across runs. Errors returned by the callback are passed
+// through as is, and when recording, are recorded in place of the output. They
+// are then replayed as a *RecordedError (see WithErrors). When replaying, a
+// command not matching the recorded one results in a *MismatchError, a
+// malformed recording results in a *ParseError, and running out of recorded
+// operations results in an error wrapping ErrRecordingExhausted.
 //
-// TODO(irfansharif): We could pass a boolean to the given callback to let
-// callers distinguish between (a) and (b), helping avoid the overhead of
-// pretty-printing + parsing when run outside the context of tests.
+// Callers that want to avoid the overhead of pretty-printing + parsing outputs
+// when run outside the context of tests (i.e. (a) above) can consult Mode, or
+// use the typed variant Do.
 func (r *Recorder) Next(command string, f func() (output string, err error)) (string, error) {
 	if r == nil {
 		// (a) Do the real thing; we're not recording or replaying.
 		output, err := f()
 		return output, err
 	}
+	if r.reporter != nil {
+		r.reporter.Helper()
+	}
+	return r.next(command, f, nil)
+}
+
+// next is Next, recording the operation at the given reserved position, if
+// any (see Reserve).
+func (r *Recorder) next(command string, f func() (output string, err error), slot *reservation) (string, error) {
+	if r.reporter != nil {
+		r.reporter.Helper()
+	}
 
+	command = r.redact(r.normalize(command))
 	if r.recording() {
-		// (b) We're recording, labeling with the given command name.
+		// (b) We're recording, labeling with the given command name. Errors
+		// are recorded in place of the output. If only recording operations
+		// missing from an earlier recording, we first look it up there.
+		if op, ok, err := r.lookupExisting(command, slot); err != nil {
+			return "", r.maybeFatal(err)
+		} else if ok {
+			return r.replay(op)
+		}
+
 		output, err := f()
-		if err != nil {
+		if err == errUnrecorded {
 			return "", err
 		}
 
-		op := operation{command, output}
-		if err := r.record(op); err != nil {
-			log.Fatalf("%v", err)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		if err := r.loadPinned(); err != nil {
+			return "", r.maybeFatal(err)
+		}
+		if pinned, ok := r.pinned.pop(command, r.matcher); ok {
+			// The pinned operation takes precedence over what we just
+			// captured.
+			if err := r.record(pinned, slot); err != nil {
+				return "", r.maybeFatal(err)
+			}
+			return r.replay(pinned)
+		}
+
+		op := operation{command: command, output: r.redact(output)}
+		if err != nil {
+			// Error messages are newline terminated, like regular output.
+			op = operation{command: command, output: r.redact(err.Error()) + "\n", isError: true}
+		}
+		if err := r.record(op, slot); err != nil {
+			return "", r.maybeFatal(err)
+		}
+		if err != nil {
+			return "", err
 		}
 		return output, nil
 	}
 
 	// (c) We're replaying from the next command in the recording.
-	var output string
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.matching == Unordered {
+		if err := r.loadIndex(); err != nil {
+			return "", r.maybeFatal(err)
+		}
+		op, ok := r.index.pop(command, r.matcher)
+		if !ok {
+			return "", r.maybeFatal(fmt.Errorf("%s: %w: recording for %q not found\n\n%s",
+				r.scanner.name, ErrRecordingExhausted, command, hint))
+		}
+		return r.replay(op)
+	}
+
+	var replayed operation
+	var mismatch error
 	found, err := r.step(func(op operation) {
-		if op.command != command {
-			log.Fatalf("%s: expected: %q\ngot: %q\n\n"+
-				"do you need to regenerate the recording using -record?",
-				r.scanner.pos(), op.command, command)
+		if !r.matches(op.command, command) {
+			mismatch = &MismatchError{
+				Name:     r.scanner.name,
+				Line:     op.line,
+				Expected: op.command,
+				Actual:   command,
+			}
 		}
-		output = op.output
+		replayed = op
 	})
 	if err != nil {
-		log.Fatalf("%v", err)
+		return "", r.maybeFatal(err)
 	}
 	if !found {
-		log.Fatalf("%s: recording for %q not found\n\n"+
-			"do you need to regenerate the recording using -record?",
-			r.scanner.pos(), command)
+		return "", r.maybeFatal(fmt.Errorf("%s: %w: recording for %q not found\n\n%s",
+			r.scanner.pos(), ErrRecordingExhausted, command, hint))
+	}
+	if mismatch != nil {
+		return "", r.maybeFatal(mismatch)
+	}
+
+	return r.replay(replayed)
+}
+
+// Reserve reserves the next position in the recording for an operation that's
+// only recorded later, say once a command started in the background completes
+// (see package exec). It returns a function to be called (once) in place of
+// Next; the operation is then recorded at the reserved position, ahead of the
+// operations recorded afterwards, regardless of which completes first. Those
+// are held back until the position is filled in, or until Flush.
+//
+// It's only of consequence when recording. Otherwise (including on a nil
+// Recorder) the returned function is simply Next, and is to be called right
+// away in order for operations to be replayed in the order they were reserved
+// in.
+func (r *Recorder) Reserve() func(command string, f func() (output string, err error)) (string, error) {
+	if !r.recording() {
+		return r.Next
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	slot := &reservation{}
+	r.reserved = append(r.reserved, slot)
+	return func(command string, f func() (output string, err error)) (string, error) {
+		if r.reporter != nil {
+			r.reporter.Helper()
+		}
+		output, err := r.next(command, f, slot)
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if fillErr := r.fill(slot); fillErr != nil {
+			return "", r.maybeFatal(fillErr)
+		}
+		return output, err
+	}
+}
+
+// reservation is a position in the recording reserved for an operation that's
+// only recorded later (see Reserve).
+type reservation struct {
+	ops    []operation // the operations recorded at this position
+	filled bool
+
+	// detached is set if the reservation was flushed before being filled in,
+	// after which its operations are recorded as usual.
+	detached bool
+}
+
+// fill marks the given reservation as filled in, writing out its operations
+// and the ones held back behind it, up until the next reservation that's yet
+// to be filled in.
+func (r *Recorder) fill(slot *reservation) error {
+	slot.filled = true
+	for len(r.reserved) > 0 && r.reserved[0].filled {
+		for _, op := range r.reserved[0].ops {
+			if err := r.emit(op); err != nil {
+				return err
+			}
+		}
+		r.reserved = r.reserved[1:]
+	}
+	return nil
+}
+
+// NextBytes is a variant of Next for operations whose output is binary (or
+// otherwise not line-oriented text). Output that's not valid UTF-8 is recorded
+// in an encoded form, and is decoded back to the original bytes when
+// replaying.
+func (r *Recorder) NextBytes(command string, f func() (output []byte, err error)) ([]byte, error) {
+	if r == nil {
+		// Do the real thing; we're not recording or replaying.
+		return f()
+	}
+	if r.reporter != nil {
+		r.reporter.Helper()
+	}
+
+	output, err := r.Next(command, func() (string, error) {
+		output, err := f()
+		return string(output), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []byte(output), nil
+}
+
+// replay returns the output of the given (replayed) operation, or if an error
+// was recorded in its place, a *RecordedError.
+func (r *Recorder) replay(op operation) (string, error) {
+	op, err := r.resolve(op)
+	if err != nil {
+		return "", r.maybeFatal(err)
+	}
+	if !op.isError {
+		return op.output, nil
+	}
+
+	msg := strings.TrimSuffix(op.output, "\n")
+	recorded := &RecordedError{Msg: msg}
+	for _, sentinel := range r.sentinels {
+		if msg == sentinel.Error() || strings.HasSuffix(msg, ": "+sentinel.Error()) {
+			recorded.sentinel = sentinel
+			break
+		}
+	}
+	return "", recorded
+}
+
+// matches returns whether the given command matches the recorded one.
+func (r *Recorder) matches(recorded, command string) bool {
+	if r.matcher == nil {
+		return recorded == command
+	}
+	return r.matcher(recorded, command)
+}
+
+// Mode describes what a Recorder is configured to do.
+type Mode int
+
+const (
+	// Live is the mode of a nil Recorder, one that transparently executes
+	// callbacks without recording or replaying anything.
+	Live Mode = iota
+	// Recording is the mode of a Recorder configured to record (see
+	// WithRecording).
+	Recording
+	// Replaying is the mode of a Recorder configured to play back from an
+	// earlier recording (see WithReplay).
+	Replaying
+)
+
+// String implements the fmt.Stringer interface.
+func (m Mode) String() string {
+	switch m {
+	case Live:
+		return "live"
+	case Recording:
+		return "recording"
+	case Replaying:
+		return "replaying"
+	default:
+		return fmt.Sprintf("mode(%d)", int(m))
+	}
+}
+
+// Mode returns what the Recorder is configured to do. It's safe to call on a
+// nil Recorder.
+func (r *Recorder) Mode() Mode {
+	if r == nil {
+		return Live
+	}
+	if r.recording() {
+		return Recording
 	}
+	return Replaying
+}
 
-	return output, nil
+// maybeFatal log.Fatal-s with the given error if the recorder is configured to
+// do so (see WithFatalOnError), or reports it if configured with a Reporter
+// (see WithReporter). Otherwise the error is simply returned.
+func (r *Recorder) maybeFatal(err error) error {
+	if r.reporter != nil {
+		r.reporter.Helper()
+		r.reporter.Fatalf("%v", err)
+	}
+	if r.fatal {
+		log.Fatalf("%v", err)
+	}
+	return err
 }
 
 // recording returns whether the recorder is configured to record (as opposed to
 // being set to replay from an existing recording).
 func (r *Recorder) recording() bool {
-	return r.writer != nil
+	return r != nil && r.writer != nil
+}
+
+// Close is intended to be called once the Recorder is no longer in use. When
+// recording, it flushes buffered operations (see Flush), completes the
+// compressed stream if any (see WithGzip and WithZstd), and closes the
+// underlying io.Writer if it's an io.Closer. When replaying, it returns an
+// error listing the recorded operations that were not played back, if any;
+// such stale operations are typically removed by re-recording. It's a no-op on
+// a nil Recorder.
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	if r.recording() {
+		// The writer is closed even if flushing fails, so as to not leak it.
+		// The first error is returned.
+		err := r.Flush()
+		if closer, ok := r.writer.(io.Closer); ok {
+			if closeErr := closer.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		return err
+	}
+
+	ops, err := r.unconsumed()
+	if err != nil {
+		return err
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d recorded operation(s) were not played back:", len(ops))
+	for _, op := range ops {
+		fmt.Fprintf(&sb, "\n%s:%d: %s", r.scanner.name, op.line, op.command)
+	}
+	fmt.Fprintf(&sb, "\n\n%s", hint)
+	return errors.New(sb.String())
+}
+
+// lookupExisting looks up the given command in the earlier recording, if we're
+// only recording operations missing from it (see WithRecordMissing). If found,
+// the operation is recorded as is, at the given reserved position if any.
+func (r *Recorder) lookupExisting(command string, slot *reservation) (op operation, ok bool, err error) {
+	if r.merge == nil {
+		return operation{}, false, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.loadExisting(); err != nil {
+		return operation{}, false, err
+	}
+	op, ok = r.existing.pop(command, r.matcher)
+	if !ok {
+		return operation{}, false, nil
+	}
+	if err := r.record(op, slot); err != nil {
+		return operation{}, false, err
+	}
+	return op, true, nil
+}
+
+// Flush writes out operations buffered when recording (see WithConcurrency and
+// WithRecordMissing). It also emits warnings for operations pinned in an
+// earlier recording that were not exercised (see WithPreserve). It's a no-op
+// otherwise (including on a nil Recorder), and is intended to be called once
+// recording is complete (Close does so).
+func (r *Recorder) Flush() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.recording() {
+		if err := r.loadPinned(); err != nil {
+			return err
+		}
+		for _, op := range r.pinned.remaining() {
+			r.warnf("%s:%d: dropping pinned operation %q, it's no longer exercised",
+				r.preserve.scanner.name, op.line, op.command)
+		}
+		r.pinned = newIndex(nil)
+	}
+
+	// Operations held back behind reservations that are yet to be filled in
+	// are written out as is. The reservations are recorded as usual once
+	// filled in.
+	for _, slot := range r.reserved {
+		if !slot.filled {
+			slot.detached = true
+			continue
+		}
+		for _, op := range slot.ops {
+			if err := r.emit(op); err != nil {
+				return err
+			}
+		}
+	}
+	r.reserved = nil
+
+	if r.concurrent {
+		// Order operations by command, and operations with identical
+		// commands by output; the order goroutines happened to run in is of no
+		// consequence.
+		sort.SliceStable(r.buffered, func(i, j int) bool {
+			a, b := r.buffered[i], r.buffered[j]
+			if a.command != b.command {
+				return a.command < b.command
+			}
+			return a.output < b.output
+		})
+	}
+	if r.merge != nil {
+		// Retain operations from the earlier recording that were not played
+		// back.
+		if err := r.loadExisting(); err != nil {
+			return err
+		}
+		r.buffered = append(r.buffered, r.existing.remaining()...)
+		r.existing = newIndex(nil)
+	}
+	for _, op := range r.buffered {
+		if err := r.write(op); err != nil {
+			return err
+		}
+	}
+	r.buffered = nil
+	if r.merge != nil {
+		// Retain comments found at the end of the earlier recording, at the
+		// end.
+		trailing := r.merge.trailing
+		r.merge.trailing = nil
+		if err := r.writeTrailing(trailing); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// record is used to record the given operation.
-func (r *Recorder) record(op operation) error {
+// record is used to record the given operation, at the given reserved
+// position if any (see Reserve). Large outputs are stored separately (see
+// WithBlobThreshold).
+func (r *Recorder) record(op operation, slot *reservation) error {
 	if !r.recording() {
 		return errors.New("misconfigured recorder: not set to record")
 	}
 
-	_, err := r.writer.Write([]byte(op.String()))
+	op, err := r.externalize(op)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case slot != nil && !slot.detached:
+		// It's written out once the reservation is filled in (see fill).
+		slot.ops = append(slot.ops, op)
+		return nil
+	case slot == nil && len(r.reserved) > 0:
+		// It's held back until earlier reservations are filled in.
+		r.reserved = append(r.reserved, &reservation{ops: []operation{op}, filled: true})
+		return nil
+	}
+	return r.emit(op)
+}
+
+// emit writes out the given (recorded) operation, or buffers it until Flush
+// (see WithConcurrency and WithRecordMissing).
+func (r *Recorder) emit(op operation) error {
+	if r.concurrent || r.merge != nil {
+		r.buffered = append(r.buffered, op)
+		return nil
+	}
+	return r.write(op)
+}
+
+// write writes out the given operation to the underlying writer.
+func (r *Recorder) write(op operation) error {
+	data, err := r.getFormat().encode(op)
 	if err != nil {
 		return fmt.Errorf("unable to write recording for %q: %v", op.command, err)
 	}
+	if _, err := r.writer.Write(data); err != nil {
+		return fmt.Errorf("unable to write recording for %q: %v", op.command, err)
+	}
+	return nil
+}
+
+// writeTrailing writes out the given comments found at the end of a
+// recording, if any.
+func (r *Recorder) writeTrailing(comments []string) error {
+	if len(comments) == 0 {
+		return nil
+	}
+	data, err := r.getFormat().encodeTrailing(comments)
+	if err != nil {
+		return fmt.Errorf("unable to write recording: %v", err)
+	}
+	if _, err := r.writer.Write(data); err != nil {
+		return fmt.Errorf("unable to write recording: %v", err)
+	}
 	return nil
 }
 
+// getFormat returns the Format the recording is serialized as.
+func (r *Recorder) getFormat() Format {
+	if r.format == nil {
+		return textFormat{}
+	}
+	return r.format
+}
+
 // step is used to iterate through the next operation found in the recording, if
 // any.
 func (r *Recorder) step(f func(operation)) (found bool, err error) {
@@ -237,9 +941,14 @@ func (r *Recorder) step(f func(operation)) (found bool, err error) {
 		return false, errors.New("misconfigured recorder; set to record, not replay")
 	}
 
-	parsed, err := r.parseOperation()
+	parsed, err := r.getFormat().decode(r)
+	if scanErr := r.scanner.Err(); scanErr != nil {
+		// Failing to read the recording (say, a truncated compressed stream)
+		// takes precedence over whatever we parsed out of it.
+		return false, r.scanner.errorf("unable to read recording: %v", scanErr)
+	}
 	if err != nil {
-		return false, fmt.Errorf("%s: unable to parse recording file: %v", r.scanner.name, err)
+		return false, err
 	}
 
 	if !parsed {
@@ -249,3 +958,89 @@ func (r *Recorder) step(f func(operation)) (found bool, err error) {
 	f(r.op)
 	return true, nil
 }
+
+// loadIndex loads the rest of the recording into an index, if not already
+// loaded.
+func (r *Recorder) loadIndex() error {
+	if r.index != nil {
+		return nil
+	}
+
+	ops, err := r.readAll()
+	if err != nil {
+		return err
+	}
+	r.index = newIndex(ops)
+	return nil
+}
+
+// loadPinned loads operations annotated with the keep directive in the
+// recording we're to preserve, if any and if not already loaded.
+func (r *Recorder) loadPinned() error {
+	if r.pinned != nil {
+		return nil
+	}
+	if r.preserve == nil {
+		r.pinned = newIndex(nil)
+		return nil
+	}
+
+	ops, err := r.preserve.readAll()
+	if err != nil {
+		// Carry on without preserving anything, rather than failing every
+		// subsequent call.
+		r.pinned = newIndex(nil)
+		return err
+	}
+	var pinned []operation
+	for _, op := range ops {
+		if op.keep {
+			pinned = append(pinned, op)
+		}
+	}
+	r.pinned = newIndex(pinned)
+	return nil
+}
+
+// loadExisting loads the operations in the earlier recording we're merging
+// into, if not already loaded.
+func (r *Recorder) loadExisting() error {
+	if r.existing != nil {
+		return nil
+	}
+
+	ops, err := r.merge.readAll()
+	if err != nil {
+		return err
+	}
+	r.existing = newIndex(ops)
+	return nil
+}
+
+// unconsumed returns the operations in the recording that are yet to be played
+// back.
+func (r *Recorder) unconsumed() ([]operation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.index != nil {
+		return r.index.remaining(), nil
+	}
+	return r.readAll()
+}
+
+// readAll reads out the rest of the operations in the recording.
+func (r *Recorder) readAll() ([]operation, error) {
+	var ops []operation
+	for {
+		found, err := r.step(func(op operation) {
+			ops = append(ops, op)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return ops, nil
+		}
+	}
+}
@@ -16,7 +16,14 @@ package recorder
 
 import (
 	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -84,7 +91,7 @@ output
 		// Write out the next operation, just to see that it goes through.
 		buffer := bytes.NewBuffer(nil)
 		writer := New(WithRecording(buffer))
-		require.NoError(t, writer.record(operation{command, output}))
+		require.NoError(t, writer.record(operation{command: command, output: output}, nil))
 
 		// Re-read what we just wrote out, just to see we're able to round trip
 		// through the recorder.
@@ -116,8 +123,6 @@ func TestRecorderMalformed(t *testing.T) {
 }
 
 func TestRecorderParse(t *testing.T) {
-	t.Skip("we don't handle trailing newlines well, we strip them off")
-
 	data := `
 0
 ----
@@ -141,7 +146,7 @@ f
 	// Write out the next operation, just to see that it goes through.
 	buffer := bytes.NewBuffer(nil)
 	writer := New(WithRecording(buffer))
-	require.NoError(t, writer.record(operation{command, output}))
+	require.NoError(t, writer.record(operation{command: command, output: output}, nil))
 
 	// Re-read what we just wrote out, just to see we're able to round trip
 	// through the recorder.
@@ -165,3 +170,591 @@ test-cmd
 `
 	require.Equal(t, strings.TrimLeft(expected, "\n"), op.String())
 }
+
+func TestRecorderErrors(t *testing.T) {
+	data := `
+command
+----
+output
+`
+
+	t.Run("mismatch", func(t *testing.T) {
+		reader := New(WithReplay(bytes.NewReader([]byte(data)), "recording"))
+		_, err := reader.Next("other-command", func() (string, error) {
+			t.Fatal("unexpected callback invocation when replaying")
+			return "", nil
+		})
+
+		var mismatch *MismatchError
+		require.True(t, errors.As(err, &mismatch))
+		require.Equal(t, "recording", mismatch.Name)
+		require.Equal(t, 2, mismatch.Line)
+		require.Equal(t, "command", mismatch.Expected)
+		require.Equal(t, "other-command", mismatch.Actual)
+	})
+
+	t.Run("exhausted", func(t *testing.T) {
+		reader := New(WithReplay(bytes.NewReader([]byte(data)), "recording"))
+		_, err := reader.Next("command", nil)
+		require.NoError(t, err)
+
+		_, err = reader.Next("command", nil)
+		require.True(t, errors.Is(err, ErrRecordingExhausted))
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		malformed := `
+command
+output
+`
+		reader := New(WithReplay(bytes.NewReader([]byte(malformed)), "recording"))
+		_, err := reader.Next("command", nil)
+
+		var parseErr *ParseError
+		require.True(t, errors.As(err, &parseErr))
+		require.Equal(t, "recording", parseErr.Name)
+		require.Equal(t, 3, parseErr.Line)
+	})
+
+	t.Run("annotation", func(t *testing.T) {
+		for _, tc := range []struct {
+			separator string
+			column    int
+			msg       string
+		}{
+			{"---- bogus", 6, `unrecognized separator annotation "bogus"`},
+			{"----  error  noeol", 14, `separator annotation "noeol" is only valid for heredocs`},
+			{"---- <<EOF base64", 12, `separator annotation "base64" is not valid for heredocs`},
+			{"---- blob", 6, `expected blob reference (sha256:<hash>) after separator annotation "blob"`},
+		} {
+			reader := New(WithReplay(strings.NewReader("command\n"+tc.separator+"\noutput\n"), "recording"))
+			_, err := reader.Next("command", nil)
+
+			var parseErr *ParseError
+			require.True(t, errors.As(err, &parseErr), tc.separator)
+			require.Equal(t, ParseError{Name: "recording", Line: 2, Column: tc.column, Msg: tc.msg}, *parseErr)
+			require.EqualError(t, err, fmt.Sprintf("recording:2:%d: %s", tc.column, tc.msg))
+		}
+	})
+
+	t.Run("callback", func(t *testing.T) {
+		buffer := bytes.NewBuffer(nil)
+		recorder := New(WithRecording(buffer), WithFatalOnError())
+		_, err := recorder.Next("command", func() (string, error) {
+			return "", io.ErrUnexpectedEOF
+		})
+		require.Equal(t, io.ErrUnexpectedEOF, err)
+	})
+}
+
+// TestNoFlags checks that the package doesn't register flags of its own (see
+// package rectest), which would otherwise conflict with the ones users define.
+func TestNoFlags(t *testing.T) {
+	for _, name := range []string{"record", "record-missing"} {
+		require.Nil(t, flag.Lookup(name), name)
+	}
+}
+
+func TestRecorderConcurrency(t *testing.T) {
+	const numGoroutines = 10
+
+	run := func(r *Recorder) []string {
+		outputs := make([]string, numGoroutines)
+		var wg sync.WaitGroup
+		for i := 0; i < numGoroutines; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				command := fmt.Sprintf("command-%d", i)
+				output, err := r.Next(command, func() (string, error) {
+					return fmt.Sprintf("output-%d\n", i), nil
+				})
+				require.NoError(t, err)
+				outputs[i] = output
+			}(i)
+		}
+		wg.Wait()
+		return outputs
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	recorder := New(WithRecording(buffer), WithConcurrency())
+	recorded := run(recorder)
+	require.NoError(t, recorder.Flush())
+
+	// The recording is ordered by command, regardless of the order in which
+	// goroutines were scheduled.
+	var ops []string
+	reader := New(WithReplay(bytes.NewReader(buffer.Bytes()), "recording"))
+	unconsumed, err := reader.unconsumed()
+	require.NoError(t, err)
+	for _, op := range unconsumed {
+		ops = append(ops, op.command)
+	}
+	require.True(t, sort.StringsAreSorted(ops))
+	require.Len(t, ops, numGoroutines)
+
+	replayer := New(WithReplay(bytes.NewReader(buffer.Bytes()), "recording"), WithConcurrency())
+	replayed := run(replayer)
+	require.Equal(t, recorded, replayed)
+
+	unconsumed, err = replayer.unconsumed()
+	require.NoError(t, err)
+	require.Empty(t, unconsumed)
+
+	// Operations with identical commands are ordered by output.
+	buffer.Reset()
+	recorder = New(WithRecording(buffer), WithConcurrency())
+	var wg sync.WaitGroup
+	for i := numGoroutines - 1; i >= 0; i-- {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			_, err := recorder.Next("command", func() (string, error) {
+				return fmt.Sprintf("output-%d\n", i), nil
+			})
+			require.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+	require.NoError(t, recorder.Flush())
+
+	var outputs []string
+	reader = New(WithReplay(bytes.NewReader(buffer.Bytes()), "recording"))
+	unconsumed, err = reader.unconsumed()
+	require.NoError(t, err)
+	for _, op := range unconsumed {
+		outputs = append(outputs, op.output)
+	}
+	require.True(t, sort.StringsAreSorted(outputs))
+	require.Len(t, outputs, numGoroutines)
+}
+
+func TestRecorderUnordered(t *testing.T) {
+	data := `
+command-a
+----
+output-a-1
+
+command-b
+----
+output-b
+
+command-a
+----
+output-a-2
+
+command-c
+----
+output-c
+`
+
+	reader := New(WithReplay(bytes.NewReader([]byte(data)), "recording"), WithMatching(Unordered))
+	for _, tc := range []struct {
+		command, output string
+	}{
+		{"command-b", "output-b\n"},
+		{"command-a", "output-a-1\n"},
+		{"command-a", "output-a-2\n"},
+	} {
+		output, err := reader.Next(tc.command, nil)
+		require.NoError(t, err)
+		require.Equal(t, tc.output, output)
+	}
+
+	_, err := reader.Next("command-a", nil)
+	require.True(t, errors.Is(err, ErrRecordingExhausted))
+
+	unconsumed, err := reader.unconsumed()
+	require.NoError(t, err)
+	require.Len(t, unconsumed, 1)
+	require.Equal(t, "command-c", unconsumed[0].command)
+	require.Equal(t, 14, unconsumed[0].line)
+}
+
+func TestRecorderReplayErrors(t *testing.T) {
+	buffer := bytes.NewBuffer(nil)
+	recorder := New(WithRecording(buffer))
+	_, err := recorder.Next("open foo", func() (string, error) {
+		return "", fmt.Errorf("open foo: %w", os.ErrNotExist)
+	})
+	require.True(t, errors.Is(err, os.ErrNotExist))
+
+	_, err = recorder.Next("open bar", func() (string, error) {
+		return "", errors.New("permission\n\ndenied")
+	})
+	require.Error(t, err)
+
+	expected := `
+open foo
+---- error
+open foo: file does not exist
+
+open bar
+---- error
+----
+permission
+
+denied
+----
+----
+
+`
+	require.Equal(t, strings.TrimLeft(expected, "\n"), buffer.String())
+
+	reader := New(WithReplay(bytes.NewReader(buffer.Bytes()), "recording"), WithErrors(os.ErrNotExist))
+	_, err = reader.Next("open foo", nil)
+	require.True(t, errors.Is(err, os.ErrNotExist))
+	require.Equal(t, "open foo: file does not exist", err.Error())
+
+	_, err = reader.Next("open bar", nil)
+	var recorded *RecordedError
+	require.True(t, errors.As(err, &recorded))
+	require.Equal(t, "permission\n\ndenied", recorded.Msg)
+	require.Nil(t, errors.Unwrap(err))
+}
+
+func TestRecorderPreserve(t *testing.T) {
+	earlier := `
+# keep
+command-a
+----
+trimmed-output-a
+
+command-b
+----
+output-b
+
+# keep
+command-c
+----
+output-c
+`
+
+	buffer := bytes.NewBuffer(nil)
+	recorder := New(WithRecording(buffer), WithPreserve(strings.NewReader(earlier), "earlier"))
+	var warnings []string
+	recorder.warnf = func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+
+	var invoked bool
+	output, err := recorder.Next("command-a", func() (string, error) {
+		invoked = true
+		return "output-a\n", nil
+	})
+	require.NoError(t, err)
+	require.True(t, invoked) // still invoked, for any side-effects
+	require.Equal(t, "trimmed-output-a\n", output)
+
+	output, err = recorder.Next("command-b", func() (string, error) {
+		return "new-output-b\n", nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "new-output-b\n", output)
+	require.NoError(t, recorder.Flush())
+
+	expected := `
+# keep
+command-a
+----
+trimmed-output-a
+
+command-b
+----
+new-output-b
+
+`
+	require.Equal(t, strings.TrimLeft(expected, "\n"), buffer.String())
+	require.Len(t, warnings, 1)
+	require.Equal(t, `earlier:12: dropping pinned operation "command-c", it's no longer exercised`, warnings[0])
+}
+
+func TestRecorderReserve(t *testing.T) {
+	callback := func(output string) func() (string, error) {
+		return func() (string, error) {
+			return output + "\n", nil
+		}
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	recorder := New(WithRecording(buffer))
+	nextA, nextB := recorder.Reserve(), recorder.Reserve()
+	_, err := recorder.Next("command-c", callback("output-c"))
+	require.NoError(t, err)
+	_, err = nextB("command-b", callback("output-b"))
+	require.NoError(t, err)
+	require.Empty(t, buffer.String()) // held back behind command-a
+
+	_, err = nextA("command-a", callback("output-a"))
+	require.NoError(t, err)
+	require.Equal(t, "command-a\n----\noutput-a\n\ncommand-b\n----\noutput-b\n\ncommand-c\n----\noutput-c\n\n", buffer.String())
+
+	// Reservations that are yet to be filled in by Flush are recorded as
+	// usual once they are.
+	buffer.Reset()
+	nextD := recorder.Reserve()
+	_, err = recorder.Next("command-e", callback("output-e"))
+	require.NoError(t, err)
+	require.NoError(t, recorder.Flush())
+	_, err = nextD("command-d", callback("output-d"))
+	require.NoError(t, err)
+	require.Equal(t, "command-e\n----\noutput-e\n\ncommand-d\n----\noutput-d\n\n", buffer.String())
+
+	// When replaying, it's simply Next.
+	replayer := New(WithReplay(strings.NewReader("command-a\n----\noutput-a\n"), "recording"))
+	output, err := replayer.Reserve()("command-a", nil)
+	require.NoError(t, err)
+	require.Equal(t, "output-a\n", output)
+}
+
+func TestRecorderPreserveMalformed(t *testing.T) {
+	buffer := bytes.NewBuffer(nil)
+	recorder := New(WithRecording(buffer), WithPreserve(strings.NewReader("command-a\noutput-a\n"), "earlier"))
+	callback := func() (string, error) {
+		return "output\n", nil
+	}
+
+	// The malformed recording is reported once, after which we carry on
+	// recording without preserving anything.
+	_, err := recorder.Next("command-a", callback)
+	var parseErr *ParseError
+	require.True(t, errors.As(err, &parseErr))
+	_, err = recorder.Next("command-b", callback)
+	require.NoError(t, err)
+	require.NoError(t, recorder.Flush())
+	require.Equal(t, "command-b\n----\noutput\n\n", buffer.String())
+}
+
+func TestRecorderRecordMissing(t *testing.T) {
+	earlier := `
+# header
+
+# fetched by hand
+command-a
+----
+output-a
+
+command-b
+----
+output-b
+
+# trailing
+`
+
+	buffer := bytes.NewBuffer(nil)
+	recorder := New(WithRecordMissing(strings.NewReader(earlier), "earlier", buffer))
+	output, err := recorder.Next("command-a", func() (string, error) {
+		t.Fatal("unexpected callback invocation for recorded operation")
+		return "", nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "output-a\n", output)
+
+	output, err = recorder.Next("command-c", func() (string, error) {
+		return "output-c\n", nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "output-c\n", output)
+
+	require.Empty(t, buffer.String()) // nothing's written out until flushed
+	require.NoError(t, recorder.Flush())
+
+	expected := `
+# header
+
+# fetched by hand
+command-a
+----
+output-a
+
+command-c
+----
+output-c
+
+command-b
+----
+output-b
+
+# trailing
+`
+	require.Equal(t, strings.TrimLeft(expected, "\n"), buffer.String())
+
+	// Flushing again doesn't write anything out twice.
+	buffer.Reset()
+	require.NoError(t, recorder.Flush())
+	require.Empty(t, buffer.String())
+}
+
+func TestDo(t *testing.T) {
+	var encoded, decoded int
+	encode := func(v []string) (string, error) {
+		encoded++
+		return strings.Join(v, "\n") + "\n", nil
+	}
+	decode := func(s string) ([]string, error) {
+		decoded++
+		return strings.Split(strings.TrimSuffix(s, "\n"), "\n"), nil
+	}
+	f := func() ([]string, error) {
+		return []string{"a", "b"}, nil
+	}
+
+	var live *Recorder
+	require.Equal(t, Live, live.Mode())
+	result, err := Do(live, "command", f, encode, decode)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b"}, result)
+	require.Equal(t, 0, encoded)
+	require.Equal(t, 0, decoded)
+
+	buffer := bytes.NewBuffer(nil)
+	recorder := New(WithRecording(buffer))
+	require.Equal(t, Recording, recorder.Mode())
+	result, err = Do(recorder, "command", f, encode, decode)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b"}, result)
+	require.Equal(t, 1, encoded)
+	require.Equal(t, 0, decoded)
+
+	replayer := New(WithReplay(buffer, "recording"))
+	require.Equal(t, Replaying, replayer.Mode())
+	result, err = Do(replayer, "command", func() ([]string, error) {
+		t.Fatal("unexpected callback invocation when replaying")
+		return nil, nil
+	}, encode, decode)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b"}, result)
+	require.Equal(t, 1, encoded)
+	require.Equal(t, 1, decoded)
+
+	// Errors encoding the result are returned, but not recorded.
+	buffer.Reset()
+	_, err = Do(recorder, "command", f, func([]string) (string, error) {
+		return "", errors.New("unable to encode")
+	}, decode)
+	require.EqualError(t, err, "unable to encode")
+	require.Empty(t, buffer.String())
+}
+
+// closeBuffer is a bytes.Buffer that tracks whether it was closed.
+type closeBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (c *closeBuffer) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestRecorderClose(t *testing.T) {
+	buffer := &closeBuffer{}
+	recorder := New(WithRecording(buffer), WithConcurrency())
+	for _, command := range []string{"command-b", "command-a", "command-c"} {
+		_, err := recorder.Next(command, func() (string, error) {
+			return "output\n", nil
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, recorder.Close())
+	require.True(t, buffer.closed)
+
+	replayer := New(WithReplay(bytes.NewReader(buffer.Bytes()), "recording"))
+	_, err := replayer.Next("command-a", nil)
+	require.NoError(t, err)
+
+	expected := `
+2 recorded operation(s) were not played back:
+recording:5: command-b
+recording:9: command-c
+
+do you need to regenerate the recording using -record?`
+	require.EqualError(t, replayer.Close(), strings.TrimLeft(expected, "\n"))
+
+	replayer = New(WithReplay(bytes.NewReader(buffer.Bytes()), "recording"), WithMatching(Unordered))
+	for _, command := range []string{"command-c", "command-b", "command-a"} {
+		_, err := replayer.Next(command, nil)
+		require.NoError(t, err)
+	}
+	require.NoError(t, replayer.Close())
+
+	// The writer is closed even if flushing fails.
+	buffer = &closeBuffer{}
+	recorder = New(WithRecordMissing(strings.NewReader("command\noutput\n"), "earlier", buffer), WithGzip())
+	var parseErr *ParseError
+	require.True(t, errors.As(recorder.Close(), &parseErr))
+	require.True(t, buffer.closed)
+
+	// Nil (live) Recorders can be closed too.
+	var live *Recorder
+	require.NoError(t, live.Flush())
+	require.NoError(t, live.Close())
+}
+
+func TestOperationRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		output, printed string
+	}{
+		{"", "cmd\n----\n\n"},
+		{"a\n", "cmd\n----\na\n\n"},
+		{"a\n\nb\n", "cmd\n----\n----\na\n\nb\n----\n----\n\n"},
+		{"a\n\n", "cmd\n----\n----\na\n\n----\n----\n\n"},
+		{" \n", "cmd\n----\n----\n \n----\n----\n\n"},
+		{"a", "cmd\n---- <<EOF noeol\na\nEOF\n\n"},
+		{"----\n", "cmd\n---- <<EOF\n----\nEOF\n\n"},
+		{"----\n----\nEOF\n", "cmd\n---- <<EOF1\n----\n----\nEOF\nEOF1\n\n"},
+		{"a\r\n\r\n", "cmd\n----\n----\na\r\n\r\n----\n----\n\n"},
+		{"----\r\n", "cmd\n---- <<EOF\n----\r\nEOF\n\n"},
+		{"\x00", "cmd\n---- base64\nAA==\n\n"},
+		{"\xffa\n", "cmd\n---- base64\n/2EK\n\n"},
+	} {
+		op := operation{command: "cmd", output: tc.output}
+		require.Equal(t, tc.printed, op.String())
+
+		reader := New(WithReplay(strings.NewReader(op.String()), "recording"))
+		output, err := reader.Next("cmd", nil)
+		require.NoError(t, err)
+		require.Equal(t, tc.output, output)
+	}
+}
+
+func TestRecorderNextBytes(t *testing.T) {
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	recorder := New(WithRecording(buffer))
+	output, err := recorder.NextBytes("binary", func() ([]byte, error) {
+		return data, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, data, output)
+	require.True(t, strings.HasPrefix(buffer.String(), "binary\n---- base64\n"))
+
+	replayer := New(WithReplay(bytes.NewReader(buffer.Bytes()), "recording"))
+	output, err = replayer.NextBytes("binary", nil)
+	require.NoError(t, err)
+	require.Equal(t, data, output)
+
+	recording := `
+hand-written
+---- hex
+00ff 0a
+de ad
+`
+	replayer = New(WithReplay(strings.NewReader(recording), "recording"))
+	output, err = replayer.NextBytes("hand-written", nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x00, 0xff, 0x0a, 0xde, 0xad}, output)
+
+	replayer = New(WithReplay(strings.NewReader("malformed\n---- base64\n!!\n"), "recording"))
+	_, err = replayer.NextBytes("malformed", nil)
+	var parseErr *ParseError
+	require.True(t, errors.As(err, &parseErr))
+	require.Contains(t, parseErr.Error(), "unable to decode base64 output")
+}
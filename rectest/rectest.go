@@ -0,0 +1,218 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package rectest integrates Recorders with Go tests, recording into or
+// replaying from files under testdata/ depending on the -record and
+// -record-missing flags.
+package rectest
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/irfansharif/recorder"
+)
+
+// hint is appended to errors that are typically addressed by re-recording.
+const hint = "do you need to regenerate the recording using -record?"
+
+var recordFlag = flag.Bool(
+	"record", false,
+	"ignore existing recordings and rewrite them with results from an actual execution",
+)
+
+var recordMissingFlag = flag.Bool(
+	"record-missing", false,
+	"play back from existing recordings, only recording operations missing from them",
+)
+
+// ForTest constructs a Recorder for use in the given test. If the -record flag
+// is specified, it records into the file at the given path (creating it and
+// its parent directories if needed). Otherwise it replays from it. If the path
+// is empty, it defaults to testdata/<test name>. If the -record-missing flag is
+// specified instead, it only records operations missing from the file (see
+// recorder.WithRecordMissing), creating it if needed.
+//
+// Errors encountered by Next (mismatched commands, malformed recordings, etc.)
+// fail the test (see recorder.WithReporter). So does a replay that did not
+// play back every recorded operation by the time the test finishes. The
+// Recorder (and the recording file) is closed when the test finishes (see
+// recorder.Recorder.Close).
+//
+// When recording, operations pinned in the earlier recording (if any) are
+// preserved (see recorder.WithPreserve), and warnings are logged through the
+// test. Malformed earlier recordings are regenerated all the same, with a
+// warning, but without preserving anything. Large outputs are stored in the directory at <path>.blobs (see
+// recorder.WithBlobs), though only if configured using
+// recorder.WithBlobThreshold. Paths ending in .gz are recorded gzip-compressed
+// (see recorder.WithGzip), paths ending in .zst are recorded zstd-compressed
+// (see recorder.WithZstd), and paths ending in .jsonl (or .jsonl.gz, etc.) use
+// recorder.JSONLFormat (see recorder.WithFormat).
+//
+// Any provided options are applied after the replay/recording ones.
+func ForTest(t testing.TB, path string, opts ...recorder.Option) *recorder.Recorder {
+	t.Helper()
+
+	if path == "" {
+		path = filepath.Join("testdata", filepath.FromSlash(t.Name()))
+	}
+	opts = append([]recorder.Option{recorder.WithBlobs(path + ".blobs")}, opts...)
+	uncompressed := path
+	switch ext := filepath.Ext(path); ext {
+	case ".gz":
+		opts = append([]recorder.Option{recorder.WithGzip()}, opts...)
+		uncompressed = strings.TrimSuffix(path, ext)
+	case ".zst":
+		opts = append([]recorder.Option{recorder.WithZstd()}, opts...)
+		uncompressed = strings.TrimSuffix(path, ext)
+	}
+	var format recorder.Format // the text format, if nil
+	if strings.HasSuffix(uncompressed, ".jsonl") {
+		format = recorder.JSONLFormat()
+		opts = append([]recorder.Option{recorder.WithFormat(format)}, opts...)
+	}
+	opts = append(opts, recorder.WithReporter(&reporter{TB: t, goroutine: goroutineID()}))
+
+	var r *recorder.Recorder
+	switch {
+	case *recordFlag:
+		// Hold on to the earlier recording, if any, in order to preserve
+		// operations pinned in it.
+		earlier, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatalf("unable to read earlier recording: %v", err)
+		}
+		// It's parsed before it's truncated below; malformed recordings are
+		// still to be regenerated, just without preserving anything.
+		if err := parse(earlier, path, format); err != nil {
+			t.Logf("not preserving pinned operations: %v", err)
+		} else {
+			opts = append([]recorder.Option{recorder.WithPreserve(bytes.NewReader(earlier), path)}, opts...)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("unable to create directory for recording: %v", err)
+		}
+		recording, err := os.Create(path)
+		if err != nil {
+			t.Fatalf("unable to create recording: %v", err)
+		}
+
+		r = recorder.New(append([]recorder.Option{recorder.WithRecording(recording)}, opts...)...)
+		t.Cleanup(func() {
+			if err := r.Close(); err != nil {
+				t.Errorf("unable to close recording: %v", err)
+			}
+		})
+	case *recordMissingFlag:
+		earlier, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatalf("unable to read earlier recording: %v", err)
+		}
+
+		// The merged recording is only written out once the test finishes.
+		var merged bytes.Buffer
+		r = recorder.New(append([]recorder.Option{recorder.WithRecordMissing(bytes.NewReader(earlier), path, &merged)}, opts...)...)
+		t.Cleanup(func() {
+			if err := r.Close(); err != nil {
+				t.Errorf("%v", err)
+				return
+			}
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Errorf("unable to create directory for recording: %v", err)
+				return
+			}
+			if err := ioutil.WriteFile(path, merged.Bytes(), 0644); err != nil {
+				t.Errorf("unable to write recording: %v", err)
+			}
+		})
+	default:
+		recording, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("unable to open recording: %v\n\n%s", err, hint)
+		}
+		t.Cleanup(func() {
+			if err := recording.Close(); err != nil {
+				t.Errorf("unable to close recording: %v", err)
+			}
+		})
+
+		r = recorder.New(append([]recorder.Option{recorder.WithReplay(recording, path)}, opts...)...)
+		t.Cleanup(func() {
+			if t.Failed() {
+				return // no need to pile on
+			}
+			if err := r.Close(); err != nil {
+				t.Errorf("%v", err)
+			}
+		})
+	}
+
+	return r
+}
+
+// parse checks that the given recording, in the given recorder.Format, is
+// well-formed.
+func parse(recording []byte, name string, format recorder.Format) error {
+	decoder := recorder.NewDecoder(bytes.NewReader(recording), name, format)
+	for {
+		if _, err := decoder.Decode(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// reporter is the recorder.Reporter used for Recorders constructed using
+// ForTest. Tests can only be failed using Fatalf from the goroutine running
+// the test (see testing.T.FailNow), so errors encountered by other goroutines
+// (say, ones spawned by the code under test) are reported using Errorf
+// instead. They're then also returned to the caller.
+type reporter struct {
+	testing.TB
+	goroutine uint64 // the goroutine running the test
+}
+
+// Fatalf implements the recorder.Reporter interface.
+func (r *reporter) Fatalf(format string, args ...interface{}) {
+	r.TB.Helper()
+	if goroutineID() != r.goroutine {
+		r.TB.Errorf(format, args...)
+		return
+	}
+	r.TB.Fatalf(format, args...)
+}
+
+// goroutineID returns the ID of the calling goroutine, as found in the header
+// of its stack trace ("goroutine 42 [running]:").
+func goroutineID() uint64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+	return id
+}
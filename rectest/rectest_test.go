@@ -0,0 +1,321 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package rectest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/irfansharif/recorder"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeT is a testing.TB that captures reported errors and registered cleanups,
+// instead of acting on them.
+type fakeT struct {
+	testing.TB
+	name     string // defaults to "fakeT"
+	errors   []string
+	logs     []string
+	cleanups []func()
+}
+
+func (f *fakeT) Helper() {}
+
+func (f *fakeT) Name() string {
+	if f.name == "" {
+		return "fakeT"
+	}
+	return f.name
+}
+
+func (f *fakeT) Failed() bool { return len(f.errors) > 0 }
+
+func (f *fakeT) Cleanup(fn func()) { f.cleanups = append(f.cleanups, fn) }
+
+func (f *fakeT) Errorf(format string, args ...interface{}) {
+	f.errors = append(f.errors, fmt.Sprintf(format, args...))
+}
+
+func (f *fakeT) Logf(format string, args ...interface{}) {
+	f.logs = append(f.logs, fmt.Sprintf(format, args...))
+}
+
+func (f *fakeT) Fatalf(format string, args ...interface{}) {
+	f.Errorf(format, args...)
+	panic("fatal")
+}
+
+func (f *fakeT) cleanup() {
+	for i := len(f.cleanups) - 1; i >= 0; i-- {
+		f.cleanups[i]()
+	}
+}
+
+// setFlag sets the given flag for the duration of the test.
+func setFlag(t *testing.T, flag *bool) {
+	*flag = true
+	t.Cleanup(func() { *flag = false })
+}
+
+func TestForTest(t *testing.T) {
+	data := `
+command-1
+----
+output-1
+
+command-2
+----
+output-2
+`
+	path := filepath.Join(t.TempDir(), "recording")
+	require.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+
+	t.Run("unconsumed", func(t *testing.T) {
+		ft := &fakeT{}
+		r := ForTest(ft, path)
+		output, err := r.Next("command-1", nil)
+		require.NoError(t, err)
+		require.Equal(t, "output-1\n", output)
+
+		ft.cleanup()
+		require.Len(t, ft.errors, 1)
+		require.Contains(t, ft.errors[0], "1 recorded operation(s) were not played back")
+		require.Contains(t, ft.errors[0], "recording:6: command-2")
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		ft := &fakeT{}
+		r := ForTest(ft, path)
+		require.Panics(t, func() {
+			_, _ = r.Next("command-2", nil)
+		})
+
+		ft.cleanup()
+		require.Len(t, ft.errors, 1)
+		require.Contains(t, ft.errors[0], `expected: "command-1"`)
+	})
+
+	t.Run("goroutine", func(t *testing.T) {
+		// Errors encountered off the test's goroutine can't fail the test
+		// there and then; they're reported and returned instead.
+		ft := &fakeT{}
+		r := ForTest(ft, path)
+		errCh := make(chan error)
+		go func() {
+			_, err := r.Next("command-2", nil)
+			errCh <- err
+		}()
+		require.Error(t, <-errCh)
+
+		ft.cleanup()
+		require.Len(t, ft.errors, 1)
+		require.Contains(t, ft.errors[0], `expected: "command-1"`)
+	})
+}
+
+
+func TestForTestRecordMalformed(t *testing.T) {
+	setFlag(t, recordFlag)
+
+	// The earlier recording is missing a separator, but is to be regenerated
+	// all the same.
+	path := filepath.Join(t.TempDir(), "recording")
+	require.NoError(t, ioutil.WriteFile(path, []byte("# keep\ncommand-1\noutput-1\n"), 0644))
+
+	ft := &fakeT{}
+	r := ForTest(ft, path)
+	for _, command := range []string{"command-1", "command-2"} {
+		_, err := r.Next(command, func() (string, error) {
+			return "output\n", nil
+		})
+		require.NoError(t, err)
+	}
+	ft.cleanup()
+	require.Empty(t, ft.errors)
+	require.Len(t, ft.logs, 1)
+	require.Contains(t, ft.logs[0], "not preserving pinned operations")
+	require.Contains(t, ft.logs[0], "expected to find separator after command")
+
+	recording, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "command-1\n----\noutput\n\ncommand-2\n----\noutput\n\n", string(recording))
+}
+
+// next is a recorder.Recorder.Next callback returning the given output.
+func next(output string) func() (string, error) {
+	return func() (string, error) {
+		return output, nil
+	}
+}
+
+// unexpected is a recorder.Recorder.Next callback that fails the test, for
+// operations that are to be played back.
+func unexpected(t *testing.T) func() (string, error) {
+	return func() (string, error) {
+		t.Fatal("unexpected callback invocation")
+		return "", nil
+	}
+}
+
+func TestForTestRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording")
+	earlier := "# keep\ncommand-a\n----\npinned-a\n\ncommand-b\n----\nstale-b\n"
+	require.NoError(t, ioutil.WriteFile(path, []byte(earlier), 0644))
+
+	// Pinned operations are preserved, and large outputs are stored in
+	// <path>.blobs.
+	setFlag(t, recordFlag)
+	ft := &fakeT{}
+	r := ForTest(ft, path, recorder.WithBlobThreshold(16))
+	output, err := r.Next("command-a", next("output-a\n"))
+	require.NoError(t, err)
+	require.Equal(t, "pinned-a\n", output)
+	_, err = r.Next("command-b", next("a large output for command-b\n"))
+	require.NoError(t, err)
+	ft.cleanup()
+	require.Empty(t, ft.errors)
+
+	recording, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(recording), "# keep\ncommand-a\n----\npinned-a\n\ncommand-b\n---- blob sha256:"))
+	blobs, err := ioutil.ReadDir(path + ".blobs")
+	require.NoError(t, err)
+	require.Len(t, blobs, 1)
+
+	// Play it back.
+	*recordFlag = false
+	ft = &fakeT{}
+	r = ForTest(ft, path)
+	output, err = r.Next("command-a", unexpected(t))
+	require.NoError(t, err)
+	require.Equal(t, "pinned-a\n", output)
+	output, err = r.Next("command-b", unexpected(t))
+	require.NoError(t, err)
+	require.Equal(t, "a large output for command-b\n", output)
+	ft.cleanup()
+	require.Empty(t, ft.errors)
+}
+
+func TestForTestRecordMissing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.gz")
+	var earlier bytes.Buffer
+	gw := gzip.NewWriter(&earlier)
+	_, err := gw.Write([]byte("# header\n\ncommand-a\n----\noutput-a\n"))
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+	require.NoError(t, ioutil.WriteFile(path, earlier.Bytes(), 0644))
+
+	setFlag(t, recordMissingFlag)
+	ft := &fakeT{}
+	r := ForTest(ft, path)
+	output, err := r.Next("command-a", unexpected(t))
+	require.NoError(t, err)
+	require.Equal(t, "output-a\n", output)
+	output, err = r.Next("command-b", next("output-b\n"))
+	require.NoError(t, err)
+	require.Equal(t, "output-b\n", output)
+	ft.cleanup()
+	require.Empty(t, ft.errors)
+
+	// The merged recording is still compressed, and retains the header.
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, f.Close()) }()
+	gr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	merged, err := ioutil.ReadAll(gr)
+	require.NoError(t, err)
+	require.Equal(t, "# header\n\ncommand-a\n----\noutput-a\n\ncommand-b\n----\noutput-b\n\n", string(merged))
+}
+
+func TestForTestFormats(t *testing.T) {
+	for _, tc := range []struct {
+		ext    string
+		prefix []byte
+	}{
+		{"", []byte("command\n----\n")},
+		{".gz", []byte{0x1f, 0x8b}},
+		{".zst", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+		{".jsonl", []byte(`{"command":"command"`)},
+	} {
+		t.Run(tc.ext, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "recording"+tc.ext)
+
+			setFlag(t, recordFlag)
+			ft := &fakeT{}
+			_, err := ForTest(ft, path).Next("command", next("output\n"))
+			require.NoError(t, err)
+			ft.cleanup()
+			require.Empty(t, ft.errors)
+
+			data, err := ioutil.ReadFile(path)
+			require.NoError(t, err)
+			require.True(t, bytes.HasPrefix(data, tc.prefix), "%q", data)
+
+			*recordFlag = false
+			ft = &fakeT{}
+			output, err := ForTest(ft, path).Next("command", unexpected(t))
+			require.NoError(t, err)
+			require.Equal(t, "output\n", output)
+			ft.cleanup()
+			require.Empty(t, ft.errors)
+		})
+	}
+
+	// Compressed JSONL recordings are compressed JSON Lines.
+	path := filepath.Join(t.TempDir(), "recording.jsonl.gz")
+	setFlag(t, recordFlag)
+	ft := &fakeT{}
+	_, err := ForTest(ft, path).Next("command", next("output\n"))
+	require.NoError(t, err)
+	ft.cleanup()
+	require.Empty(t, ft.errors)
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, f.Close()) }()
+	gr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(gr)
+	require.NoError(t, err)
+	require.Equal(t, `{"command":"command","output":"output\n"}`+"\n", string(data))
+}
+
+func TestForTestDefaultPath(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	defer func() { require.NoError(t, os.Chdir(wd)) }()
+
+	// Recordings default to testdata/<test name>, with subtests nested in
+	// directories of their own.
+	setFlag(t, recordFlag)
+	ft := &fakeT{name: "TestSomething/subtest"}
+	_, err = ForTest(ft, "").Next("command", next("output\n"))
+	require.NoError(t, err)
+	ft.cleanup()
+	require.Empty(t, ft.errors)
+
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "TestSomething", "subtest"))
+	require.NoError(t, err)
+	require.Equal(t, "command\n----\noutput\n\n", string(data))
+}
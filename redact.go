@@ -0,0 +1,98 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package recorder
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Redactor scrubs secrets (tokens, passwords, keys) from commands and outputs
+// before they're recorded, typically replacing them with the ${REDACTED}
+// placeholder (see Placeholder). Redactors are expected to be idempotent.
+type Redactor func(s string) string
+
+// WithRedactor is used to configure a Recorder to redact commands and outputs
+// (including error messages) using the given Redactor, before anything is
+// written to the recording. Commands provided to Next are redacted when
+// replaying too, so they match the recorded ones. Callers are still provided
+// the unredacted outputs when recording. Redactors are applied in the order
+// they're configured in, after any normalizers (see WithNormalizer).
+func WithRedactor(rd Redactor) Option {
+	return func(r *Recorder) {
+		r.redactors = append(r.redactors, rd)
+	}
+}
+
+// RedactPattern returns a Redactor that replaces matches of the given regular
+// expression with the ${REDACTED} placeholder. If the expression has
+// capturing groups, only the text matched by them is replaced, leaving the
+// surrounding context (say, the name of the header or parameter) intact.
+func RedactPattern(re *regexp.Regexp) Redactor {
+	placeholder := Placeholder("REDACTED")
+	return func(s string) string {
+		var sb strings.Builder
+		var last int
+		for _, match := range re.FindAllStringSubmatchIndex(s, -1) {
+			groups := match[2:]
+			if len(groups) == 0 {
+				groups = match[:2]
+			}
+			for i := 0; i < len(groups); i += 2 {
+				start, end := groups[i], groups[i+1]
+				if start < last {
+					continue // unmatched (-1) or nested group
+				}
+				sb.WriteString(s[last:start])
+				sb.WriteString(placeholder)
+				last = end
+			}
+		}
+		sb.WriteString(s[last:])
+		return sb.String()
+	}
+}
+
+// RedactBearerTokens returns a Redactor for bearer tokens, as found in
+// "Authorization: Bearer <token>" headers.
+func RedactBearerTokens() Redactor {
+	return RedactPattern(bearerRE)
+}
+
+// RedactAWSKeys returns a Redactor for AWS-style access key IDs (AKIA...,
+// ASIA...) and secret access keys (following aws_secret_access_key).
+func RedactAWSKeys() Redactor {
+	return RedactPattern(awsRE)
+}
+
+// RedactPasswords returns a Redactor for password=<password> pairs (also
+// passwd= and pwd=), as found in connection strings and query parameters.
+func RedactPasswords() Redactor {
+	return RedactPattern(passwordRE)
+}
+
+var (
+	bearerRE   = regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9\-._~+/]+=*)`)
+	awsRE      = regexp.MustCompile(`\b((?:AKIA|ASIA)[0-9A-Z]{16})\b|(?i:aws_secret_access_key)["']?\s*[=:]\s*["']?([A-Za-z0-9/+=]{40})`)
+	passwordRE = regexp.MustCompile(`(?i)\b(?:password|passwd|pwd)=([^\s&"';]+)`)
+)
+
+// redact applies the configured redactors to the given string.
+func (r *Recorder) redact(s string) string {
+	for _, rd := range r.redactors {
+		s = rd(s)
+	}
+	return s
+}
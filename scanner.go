@@ -19,6 +19,7 @@ package recorder
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 )
@@ -37,12 +38,28 @@ func newScanner(r io.Reader, name string) *scanner {
 	// We use a large max-token-size to account for lines in the output that far
 	// exceed the default bufio scanner token size.
 	bufioScanner.Buffer(make([]byte, 100), 10*bufio.MaxScanTokenSize)
+	bufioScanner.Split(scanLines)
 	return &scanner{
 		Scanner: bufioScanner,
 		name:    name,
 	}
 }
 
+// scanLines is a bufio.SplitFunc that's identical to bufio.ScanLines, except
+// that it retains carriage returns, keeping outputs byte-exact.
+func scanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil // request more data
+}
+
 func (s *scanner) Scan() bool {
 	ok := s.Scanner.Scan()
 	if ok {
@@ -56,3 +73,20 @@ func (s *scanner) Scan() bool {
 func (s *scanner) pos() string {
 	return fmt.Sprintf("%s:%d", s.name, s.line)
 }
+
+// errorf returns a *ParseError positioned at the last read line.
+func (s *scanner) errorf(format string, args ...interface{}) *ParseError {
+	return &ParseError{
+		Name: s.name,
+		Line: s.line,
+		Msg:  fmt.Sprintf(format, args...),
+	}
+}
+
+// columnErrorf returns a *ParseError positioned at the given (1-indexed)
+// column of the last read line.
+func (s *scanner) columnErrorf(column int, format string, args ...interface{}) *ParseError {
+	err := s.errorf(format, args...)
+	err.Column = column
+	return err
+}
@@ -0,0 +1,131 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package recorder
+
+import (
+	"errors"
+	"io"
+)
+
+// Parse reads all the operations from the given recording, in the text format
+// (see NewDecoder for other formats). It returns a *ParseError if the
+// recording is malformed. Comments at the end of the recording, after the
+// last operation, are not returned (see Decoder.Trailing). The provided name is
+// used only for diagnostic purposes, it's typically the name of the recording
+// file being read.
+func Parse(from io.Reader, name string) ([]Operation, error) {
+	decoder := NewDecoder(from, name, TextFormat())
+	var ops []Operation
+	for {
+		op, err := decoder.Decode()
+		if err == io.EOF {
+			return ops, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+}
+
+// Decoder reads operations from a recording, one at a time.
+type Decoder struct {
+	r   *Recorder
+	err error
+}
+
+// NewDecoder returns a Decoder that reads from the given recording, in the
+// given Format (TextFormat if nil). Compressed recordings are decompressed
+// transparently. The provided name is used only for diagnostic purposes.
+func NewDecoder(from io.Reader, name string, format Format) *Decoder {
+	return &Decoder{r: New(WithReplay(from, name), WithFormat(format))}
+}
+
+// Decode returns the next operation in the recording. It returns io.EOF once
+// there are none left, and a *ParseError if the recording is malformed, after
+// which the Decoder is no longer usable.
+func (d *Decoder) Decode() (Operation, error) {
+	if d.err != nil {
+		return Operation{}, d.err
+	}
+
+	var op Operation
+	found, err := d.r.step(func(o operation) {
+		op = o.export(d.r.scanner.name)
+	})
+	if err != nil {
+		d.err = err
+		return Operation{}, err
+	}
+	if !found {
+		d.err = io.EOF
+		return Operation{}, io.EOF
+	}
+	return op, nil
+}
+
+// Trailing returns the comment lines found at the end of the recording, after
+// the last operation, once Decode has returned io.EOF. Blank lines separating
+// them are retained as empty strings.
+func (d *Decoder) Trailing() []string {
+	return d.r.trailing
+}
+
+// Encoder writes operations out to a recording, one at a time.
+type Encoder struct {
+	r *Recorder
+}
+
+// NewEncoder returns an Encoder that writes to the given io.Writer, in the
+// given Format (TextFormat if nil).
+func NewEncoder(to io.Writer, format Format) *Encoder {
+	return &Encoder{r: New(WithRecording(to), WithFormat(format))}
+}
+
+// Encode writes out the given operation. Its position, if any, is ignored.
+func (e *Encoder) Encode(op Operation) error {
+	return e.r.write(op.internal())
+}
+
+// EncodeTrailing writes out the given comment lines, intended for the end of
+// the recording, after the last operation (see Decoder.Trailing). It's a
+// no-op if there are none.
+func (e *Encoder) EncodeTrailing(comments []string) error {
+	return e.r.writeTrailing(comments)
+}
+
+// Lint reads the recording from the given io.Reader in the given Format,
+// returning all the errors found in it, as opposed to only the first. After
+// running into a malformed operation, it resumes from the next one. The
+// provided name is used only for diagnostic purposes.
+func Lint(from io.Reader, name string, format Format) []error {
+	r := New(WithReplay(from, name), WithFormat(format))
+	var errs []error
+	for {
+		found, err := r.step(func(operation) {})
+		if err != nil {
+			errs = append(errs, err)
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) || r.scanner.Err() != nil {
+				return errs // we're unable to read any further
+			}
+			r.getFormat().resync(r)
+			continue
+		}
+		if !found {
+			return errs
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2021 Irfan Sharif.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package recorder
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	data := `
+# comment
+command-a
+----
+output
+
+command-b
+---- error
+failed
+`
+
+	ops, err := Parse(strings.NewReader(data), "recording")
+	require.NoError(t, err)
+	require.Equal(t, []Operation{
+		{Command: "command-a", Output: "output\n", Comments: []string{"# comment"}, Name: "recording", Line: 3},
+		{Command: "command-b", Output: "failed\n", Error: true, Name: "recording", Line: 7},
+	}, ops)
+
+	_, err = Parse(strings.NewReader("command\n---\n"), "recording")
+	var parseErr *ParseError
+	require.True(t, errors.As(err, &parseErr))
+	require.Equal(t, 2, parseErr.Line)
+}
+
+func TestDecoderEncoder(t *testing.T) {
+	var buffer bytes.Buffer
+	encoder := NewEncoder(&buffer, JSONLFormat())
+	for _, op := range []Operation{
+		{Command: "command-a", Output: "output\n", Comments: []string{"# keep"}},
+		{Command: "command-b", Output: "\xff", Error: true},
+	} {
+		require.NoError(t, encoder.Encode(op))
+	}
+
+	decoder := NewDecoder(&buffer, "recording.jsonl", JSONLFormat())
+	op, err := decoder.Decode()
+	require.NoError(t, err)
+	require.Equal(t, Operation{Command: "command-a", Output: "output\n", Comments: []string{"# keep"}, Name: "recording.jsonl", Line: 1}, op)
+	require.Equal(t, "# keep\ncommand-a\n----\noutput\n\n", op.String())
+
+	op, err = decoder.Decode()
+	require.NoError(t, err)
+	require.Equal(t, Operation{Command: "command-b", Output: "\xff", Error: true, Name: "recording.jsonl", Line: 2}, op)
+
+	_, err = decoder.Decode()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestLint(t *testing.T) {
+	data := `
+command-a
+---
+output
+
+command-b
+----
+output
+
+command-c
+---- <<EOF
+output
+`
+
+	var errs []string
+	for _, err := range Lint(strings.NewReader(data), "recording", TextFormat()) {
+		errs = append(errs, err.Error())
+	}
+	require.Equal(t, []string{
+		`recording:3: expected to find separator after command, found "---" instead`,
+		`recording:12: missing heredoc terminator "EOF"`,
+	}, errs)
+
+	data = `{"command":"a"}
+{"command":"b",}
+{"output":"c"}
+`
+	errs = nil
+	for _, err := range Lint(strings.NewReader(data), "recording", JSONLFormat()) {
+		errs = append(errs, err.Error())
+	}
+	require.Equal(t, []string{
+		`recording:2: unable to parse operation: invalid character '}' looking for beginning of object key string`,
+		`recording:3: unable to parse operation: missing command`,
+	}, errs)
+}